@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Soft thresholds an advisory is raised for, each ahead of a hard limit:
+// config.DailyCapWarnPercent of the daily cap accepted, and
+// config.InventoryWarnPercent of the last refill left in a dispenser.
+const (
+	advisoryDailyCap  = "dailyCap"
+	advisoryInventory = "inventory"
+)
+
+// Advisory is a soft threshold that has been crossed. Nothing is refused
+// for it; it lets the kiosk and integrations warn guests before the hard
+// limit behind it turns them away.
+type Advisory struct {
+	Threshold string `json:"threshold"`
+	Dispenser string `json:"dispenser,omitempty"`
+	Message   string `json:"message"`
+}
+
+type advisoryKey struct {
+	threshold, dispenser string
+}
+
+// advised is the day each advisory was last notified. Guarded by mutex.
+var advised = map[advisoryKey]string{}
+
+// advisoriesAfter lists the soft thresholds crossed once shares, tickets
+// by dispenser name, have been accepted on top of everything already
+// queued. The caller must hold mutex.
+func advisoriesAfter(dispensers []*Dispenser, shares map[string]int) []Advisory {
+	var advisories []Advisory
+
+	if config.DailyCapWarnPercent > 0 && dailyTicketsLeft() >= 0 {
+		accepted := dailyTally.tickets
+		for _, tickets := range shares {
+			accepted += tickets
+		}
+		if accepted*100 >= config.DailyCapWarnPercent*config.DailyTicketCap {
+			advisories = append(advisories, Advisory{
+				Threshold: advisoryDailyCap,
+				Message:   fmt.Sprintf("%d of today's %d tickets accepted", accepted, config.DailyTicketCap),
+			})
+		}
+	}
+
+	if config.InventoryWarnPercent > 0 {
+		for _, d := range dispensers {
+			loaded := inventory[d.Name].Loaded
+			available := d.availableTickets()
+			if available < 0 || loaded == 0 {
+				continue
+			}
+			available = max(available-shares[d.Name], 0)
+			if available*100 <= config.InventoryWarnPercent*loaded {
+				advisories = append(advisories, Advisory{
+					Threshold: advisoryInventory,
+					Dispenser: d.Name,
+					Message:   fmt.Sprintf("%d of %d tickets left in %s", available, loaded, d.Name),
+				})
+			}
+		}
+	}
+	return advisories
+}
+
+// raiseAdvisories logs and notifies each advisory now in force for
+// dispensers the first time it is crossed on a day. The caller must hold
+// mutex.
+func raiseAdvisories(dispensers []*Dispenser) {
+	day := time.Now().Format("2006-01-02")
+	for _, a := range advisoriesAfter(dispensers, nil) {
+		key := advisoryKey{a.Threshold, a.Dispenser}
+		if advised[key] == day {
+			continue
+		}
+		advised[key] = day
+		slog.Warn("Running low", "threshold", a.Threshold, "dispenser", a.Dispenser, "message", a.Message)
+		notifyWebhooks(WebhookEvent{Event: eventRunningLow, Dispenser: a.Dispenser, Reason: a.Message})
+	}
+}
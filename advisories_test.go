@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAdvisories walks a day's dispenses across the soft thresholds ahead of
+// the daily cap and the inventory running out, and then into the next day.
+func TestAdvisories(t *testing.T) {
+	useTestConfig(t)
+	config.DailyTicketCap = 100
+	config.DailyCapWarnPercent = 80
+	config.InventoryWarnPercent = 20
+
+	var mu sync.Mutex
+	var events []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		events = append(events, event.Event+" "+event.Dispenser)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	config.Webhooks = []string{receiver.URL}
+
+	_, routes := newTestRoutes(t)
+	if w := serve(routes, http.MethodPost, "/api/inventory", "application/json", `{"count": 100}`); w.Code != http.StatusOK {
+		t.Fatalf("refill status = %d: %s", w.Code, w.Body)
+	}
+
+	thresholds := func(advisories []Advisory) []string {
+		var got []string
+		for _, a := range advisories {
+			got = append(got, a.Threshold+" "+a.Dispenser)
+		}
+		return got
+	}
+	status := func() []string {
+		t.Helper()
+		var body StatusResponse
+		w := serve(routes, http.MethodGet, "/api/status", "", "")
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return thresholds(body.Advisories)
+	}
+	preview := func(tickets string) (bool, string, []string) {
+		t.Helper()
+		w := serve(routes, http.MethodPost, "/api/dispense/preview", "application/json", `{"tickets": `+tickets+`}`)
+		var body struct {
+			Allowed    bool       `json:"allowed"`
+			Reason     string     `json:"reason"`
+			Advisories []Advisory `json:"advisories"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("preview status = %d (%v): %s", w.Code, err, w.Body)
+		}
+		return body.Allowed, body.Reason, thresholds(body.Advisories)
+	}
+	// notified waits until want webhook events have come in, and a little
+	// longer for any extra, and returns them sorted.
+	notified := func(want int) []string {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			got := slices.Clone(events)
+			mu.Unlock()
+			if len(got) >= want || time.Now().After(deadline) {
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				got = slices.Clone(events)
+				mu.Unlock()
+				slices.Sort(got)
+				return got
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	daily := advisoryDailyCap + " "
+	low := advisoryInventory + " main"
+	both := []string{daily, low}
+
+	queue(t, routes, "30")
+	queue(t, routes, "45")
+	if got := status(); got != nil {
+		t.Errorf("75 accepted, 25 left: advisories = %v, want none", got)
+	}
+
+	// The preview says what another 10 would cross, without crossing it
+	if allowed, _, got := preview("10"); !allowed || !slices.Equal(got, both) {
+		t.Errorf("preview of 10: allowed = %v, advisories = %v, want allowed with %v", allowed, got, both)
+	}
+	if got := status(); got != nil {
+		t.Errorf("after the preview: advisories = %v, want none", got)
+	}
+
+	queue(t, routes, "6")
+	if got := status(); !slices.Equal(got, both) {
+		t.Errorf("81 accepted, 19 left: advisories = %v, want %v", got, both)
+	}
+	queue(t, routes, "4")
+	if got := status(); !slices.Equal(got, both) {
+		t.Errorf("85 accepted, 15 left: advisories = %v, want %v", got, both)
+	}
+
+	// The preview goes through the hard limits too
+	if allowed, reason, got := preview("20"); allowed || !strings.Contains(reason, "Only 15 tickets left") || !slices.Equal(got, both) {
+		t.Errorf("preview of 20: allowed = %v, reason = %q, advisories = %v", allowed, reason, got)
+	}
+
+	want := []string{eventRunningLow + " ", eventRunningLow + " main"}
+	if got := notified(len(want)); !slices.Equal(got, want) {
+		t.Errorf("events = %v, want one per threshold: %v", got, want)
+	}
+
+	// A new day starts the tally again, and the inventory still low is
+	// notified once more
+	mutex.Lock()
+	dailyTally.day = ""
+	for key := range advised {
+		advised[key] = "2000-01-01"
+	}
+	mutex.Unlock()
+	queue(t, routes, "1")
+	queue(t, routes, "1")
+	if got := status(); !slices.Equal(got, []string{low}) {
+		t.Errorf("next day: advisories = %v, want %v", got, []string{low})
+	}
+
+	want = append(want, eventRunningLow+" main")
+	slices.Sort(want)
+	if got := notified(len(want)); !slices.Equal(got, want) {
+		t.Errorf("next day: events = %v, want %v", got, want)
+	}
+}
+
+func TestValidateAdvisories(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"off", func(c *Config) { c.DailyCapWarnPercent, c.InventoryWarnPercent = 0, 0 }, ""},
+		{"at the cap", func(c *Config) { c.DailyCapWarnPercent = 100 }, "dailyCapWarnPercent must be from 0 to 99"},
+		{"negative", func(c *Config) { c.DailyCapWarnPercent = -1 }, "dailyCapWarnPercent must be from 0 to 99"},
+		{"full refill", func(c *Config) { c.InventoryWarnPercent = 100 }, "inventoryWarnPercent must be from 0 to 99"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.change(&c)
+
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
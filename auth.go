@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requireAPIKey guards a handler's mutating methods when API keys are
+// configured. Reads stay open so the display kiosk keeps working without a
+// key.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	guarded := requireAPIKeyAlways(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		guarded(w, r)
+	}
+}
+
+// requireAPIKeyAlways guards every method, for the few GET endpoints that
+// have side effects.
+func requireAPIKeyAlways(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.APIKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		if !validAPIKey(requestAPIKey(r)) {
+			slog.Warn("Rejected request without a valid API key", "method", r.Method, "path", r.URL.Path, "client", clientIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ticket-machine"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requestAPIKey pulls the key from either an Authorization: Bearer header
+// or X-API-Key.
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// validAPIKey compares against every configured key in constant time so the
+// response time doesn't leak how much of a key matched or which one.
+func validAPIKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	valid := 0
+	for _, candidate := range config.APIKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(candidate))
+	}
+	return valid == 1
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
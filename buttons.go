@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// buttonPollInterval is how often the button pins are sampled. Reading a
+// pin is a single register access, so this never competes with the sensor.
+const buttonPollInterval = 10 * time.Millisecond
+
+// ButtonConfig is one physical button: pressing it dispenses Tickets from
+// Dispenser, or the first dispenser if that is empty, and holding it for
+// config.LongPress toggles maintenance mode if Maintenance is set. Buttons
+// are wired between the pin and ground and read active-low with the
+// internal pull-up.
+type ButtonConfig struct {
+	Pin         int    `json:"pin"`
+	Tickets     int    `json:"tickets"`
+	Maintenance bool   `json:"maintenance"`
+	Dispenser   string `json:"dispenser,omitempty"`
+}
+
+// ButtonReader is implemented by hardware with buttons wired to it.
+type ButtonReader interface {
+	// ReadButton returns the level of a button pin set up by SafeState.
+	ReadButton(pin int) rpio.State
+}
+
+func (g *gpioHardware) ReadButton(pin int) rpio.State {
+	return openPin(pin).Read()
+}
+
+// button tracks one button through debouncing.
+type button struct {
+	ButtonConfig
+	server    *Server
+	dispenser *Dispenser
+
+	pressed   bool
+	changing  bool
+	changedAt time.Time
+	pressedAt time.Time
+	held      bool
+}
+
+// watchButtons samples every configured button until shutdown. A change of
+// level only counts once it has held for config.ButtonDebounce.
+func (s *Server) watchButtons(reader ButtonReader) {
+	buttons := make([]*button, len(config.Buttons))
+	for i, b := range config.Buttons {
+		buttons[i] = &button{ButtonConfig: b, server: s, dispenser: s.find(config.buttonDispenser(b))}
+	}
+
+	ticker := time.NewTicker(buttonPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case now := <-ticker.C:
+			for _, b := range buttons {
+				b.sample(reader.ReadButton(b.Pin) == rpio.Low, now)
+			}
+		}
+	}
+}
+
+func (b *button) sample(down bool, now time.Time) {
+	if down != b.pressed {
+		if !b.changing {
+			b.changing = true
+			b.changedAt = now
+		}
+		if now.Sub(b.changedAt) < config.ButtonDebounce.Duration {
+			return
+		}
+
+		b.changing = false
+		b.pressed = down
+
+		// Plain buttons dispense as soon as they go down. A maintenance
+		// button waits for the release to tell a press from a long-press.
+		if down {
+			b.pressedAt = now
+			b.held = false
+			if !b.Maintenance && b.Tickets > 0 {
+				buttonDispense(b.dispenser, b.Pin, b.Tickets)
+			}
+			return
+		}
+		if b.Maintenance && !b.held && b.Tickets > 0 {
+			buttonDispense(b.dispenser, b.Pin, b.Tickets)
+		}
+		return
+	}
+	b.changing = false
+
+	if b.pressed && b.Maintenance && !b.held && now.Sub(b.pressedAt) >= config.LongPress.Duration {
+		b.held = true
+		b.server.toggleMaintenance(b.Pin)
+	}
+}
+
+// buttonDispense queues a dispense on d exactly as the HTTP handler would,
+// unless d is already running one.
+func buttonDispense(d *Dispenser, pin, numTickets int) {
+	if refused := checkHours(time.Now()); refused != nil {
+		slog.Info("Ignoring button, outside operating hours", "pin", pin, "dispenser", d.Name)
+		return
+	}
+
+	mutex.Lock()
+	if d.dispensing {
+		mutex.Unlock()
+		slog.Info("Ignoring button, dispenser is busy", "pin", pin, "dispenser", d.Name)
+		return
+	}
+
+	job, _, warning, refused := admitJob(d, numTickets)
+	mutex.Unlock()
+	if refused != nil {
+		slog.Warn("Button press refused", "pin", pin, "dispenser", d.Name, "reason", refused.message)
+		return
+	}
+
+	metrics.addRequested(numTickets)
+	slog.Info("Button queued a dispense", "pin", pin, "dispenser", d.Name, "jobID", job.ID, "requested", numTickets)
+	if warning != "" {
+		slog.Warn(warning, "jobID", job.ID)
+	}
+}
+
+func (s *Server) toggleMaintenance(pin int) {
+	mutex.Lock()
+	enabled := !maintenance.Enabled
+	mutex.Unlock()
+
+	s.setMaintenance(enabled, fmt.Sprintf("long-press on the button at pin %d", pin))
+}
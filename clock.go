@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// Clock is the time a dispense runs on: the dispense loop, the motor ramp
+// and the simulated feeder all read and wait on it, so tests can swap in
+// one that only moves when they move it.
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+var clock Clock = systemClock{}
+
+// since is time.Since on clock.
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that stands still until the test moves it on.
+// Nothing waiting on it wakes up before then, so a run driven by it takes
+// the same path every time, however loaded the machine running the test.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+
+	// added is nudged whenever something starts waiting on the clock.
+	added chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// useFakeClock makes clock a fakeClock until the test ends.
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := &fakeClock{
+		now:   time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC),
+		added: make(chan struct{}, 1),
+	}
+	real := clock
+	clock = c
+	t.Cleanup(func() { clock = real })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+
+	select {
+	case c.added <- struct{}{}:
+	default:
+	}
+	return ch
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// waiting is how many timers have yet to fire.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock on by d, firing every timer due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceTo(c.now.Add(d))
+}
+
+// next moves the clock on to the earliest timer and fires it, along with
+// any other due at the same time.
+func (c *fakeClock) next() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) > 0 {
+		c.advanceTo(c.timers[0].at)
+	}
+}
+
+// advanceTo sets the clock to at and fires every timer due by then. The
+// caller must hold mu.
+func (c *fakeClock) advanceTo(at time.Time) {
+	if at.After(c.now) {
+		c.now = at
+	}
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		c.timers[0].ch <- c.now
+		c.timers = c.timers[1:]
+	}
+}
+
+// run calls fn on a goroutine of its own and returns once fn has. Every
+// time fn waits on the clock, at is called, if set, with how long fn has
+// been running, and the clock then moves on to what fn is waiting for. fn
+// never runs while at does or the clock moves, so at sees everything fn has
+// done up to then.
+func (c *fakeClock) run(fn func(), at func(elapsed time.Duration)) {
+	start := c.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	for {
+		for c.waiting() == 0 {
+			select {
+			case <-done:
+				return
+			case <-c.added:
+			}
+		}
+		if at != nil {
+			at(c.Now().Sub(start))
+		}
+		c.next()
+	}
+}
+
+// dispense is d.Dispense run on the clock.
+func (c *fakeClock) dispense(d *Dispenser, n int, at func(elapsed time.Duration)) (result Result, err error) {
+	c.run(func() { result, err = d.Dispense(context.Background(), n) }, at)
+	return result, err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// codeAlphabet leaves out 0/O and 1/I/L so codes survive being read aloud or
+// scribbled on a card.
+const (
+	codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	codeLength   = 6
+)
+
+// Code is a one-time voucher for a number of tickets.
+type Code struct {
+	Code       string     `json:"code"`
+	Tickets    int        `json:"tickets"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RedeemedAt *time.Time `json:"redeemedAt,omitempty"`
+	JobID      string     `json:"jobId,omitempty"`
+}
+
+var (
+	// codes is keyed by code. Guarded by mutex.
+	codes = map[string]*Code{}
+
+	// codesSaveMu orders saves so an older snapshot can never overwrite a
+	// newer one and bring a redeemed code back after a restart.
+	codesSaveMu sync.Mutex
+)
+
+func loadCodes(path string) error {
+	var stored []*Code
+	if err := readJSONFile(path, &stored); err != nil {
+		return fmt.Errorf("reading codes: %w", err)
+	}
+	for _, code := range stored {
+		codes[code.Code] = code
+	}
+	return nil
+}
+
+// saveCodes writes every code to disk, dropping ones that expired or were
+// redeemed more than a day ago. It must be called without mutex held.
+func saveCodes() {
+	codesSaveMu.Lock()
+	defer codesSaveMu.Unlock()
+
+	mutex.Lock()
+	cutoff := time.Now().Add(-24 * time.Hour)
+	stored := make([]Code, 0, len(codes))
+	for key, code := range codes {
+		finished := code.ExpiresAt
+		if code.RedeemedAt != nil {
+			finished = *code.RedeemedAt
+		}
+		if finished.Before(cutoff) {
+			delete(codes, key)
+			continue
+		}
+		stored = append(stored, *code)
+	}
+	mutex.Unlock()
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].CreatedAt.Before(stored[j].CreatedAt)
+	})
+	if err := writeJSONFile(config.CodesFile, stored); err != nil {
+		slog.Error("Error saving codes", "err", err)
+	}
+}
+
+// newCode picks a code that isn't already in use. The caller must hold
+// mutex.
+func newCode() string {
+	size := big.NewInt(int64(len(codeAlphabet)))
+	b := make([]byte, codeLength)
+	for {
+		for i := range b {
+			n, _ := rand.Int(rand.Reader, size)
+			b[i] = codeAlphabet[n.Int64()]
+		}
+		if _, taken := codes[string(b)]; !taken {
+			return string(b)
+		}
+	}
+}
+
+// outstanding reports whether a code can still be redeemed.
+func (c *Code) outstanding(now time.Time) bool {
+	return c.RedeemedAt == nil && now.Before(c.ExpiresAt)
+}
+
+// codesHandler lists outstanding codes on GET and creates one on POST with
+// {"tickets": N, "expiresIn": "2h"}. The whole endpoint needs an API key
+// since a listed code is as good as tickets.
+func codesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		now := time.Now()
+		mutex.Lock()
+		outstanding := []Code{}
+		for _, code := range codes {
+			if code.outstanding(now) {
+				outstanding = append(outstanding, *code)
+			}
+		}
+		mutex.Unlock()
+
+		sort.Slice(outstanding, func(i, j int) bool {
+			return outstanding[i].CreatedAt.Before(outstanding[j].CreatedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(outstanding)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var body struct {
+		Tickets   int       `json:"tickets"`
+		ExpiresIn *Duration `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Tickets <= 0 {
+		writeError(w, http.StatusBadRequest, "Body must be {\"tickets\": N, \"expiresIn\": \"2h\"} with N > 0")
+		return
+	}
+	if body.Tickets > config.MaxTicketsPerRequest {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("At most %d tickets can be dispensed per request", config.MaxTicketsPerRequest))
+		return
+	}
+
+	expiresIn := config.CodeExpiry.Duration
+	if body.ExpiresIn != nil {
+		expiresIn = body.ExpiresIn.Duration
+	}
+	if expiresIn <= 0 {
+		writeError(w, http.StatusBadRequest, "expiresIn must be greater than zero")
+		return
+	}
+
+	mutex.Lock()
+	now := time.Now()
+	code := &Code{
+		Code:      newCode(),
+		Tickets:   body.Tickets,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiresIn),
+	}
+	codes[code.Code] = code
+	created := *code
+	mutex.Unlock()
+
+	saveCodes()
+	slog.Info("Created redemption code", "code", created.Code, "tickets", created.Tickets, "expiresAt", created.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// redeemHandler queues a dispense for a code's tickets and uses the code up.
+// Checking and marking the code happen under mutex together with queueing
+// the job, so a double-submitted code is queued exactly once; a busy machine
+// queues it behind the running job.
+func (s *Server) redeemHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Throttling redeem attempts keeps codes from being guessed
+	if rateLimited(w, r) {
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		writeError(w, http.StatusBadRequest, "Body must be {\"code\": \"ABC123\"}")
+		return
+	}
+	key := strings.ToUpper(strings.TrimSpace(body.Code))
+
+	// A code is left unused while the machine is closed
+	if refused := checkHours(time.Now()); refused != nil {
+		writeError(w, refused.status, refused.message)
+		return
+	}
+
+	mutex.Lock()
+	code, ok := codes[key]
+	if !ok {
+		mutex.Unlock()
+		writeError(w, http.StatusNotFound, "Unknown code")
+		return
+	}
+	if code.RedeemedAt != nil {
+		mutex.Unlock()
+		writeError(w, http.StatusConflict, "Code has already been used")
+		return
+	}
+	now := time.Now()
+	if !now.Before(code.ExpiresAt) {
+		mutex.Unlock()
+		writeError(w, http.StatusGone, "Code has expired")
+		return
+	}
+
+	job, position, warning, refused := admitJob(s.dispensers[0], code.Tickets)
+	if refused != nil {
+		mutex.Unlock()
+		writeError(w, refused.status, refused.message)
+		return
+	}
+	code.RedeemedAt = &now
+	code.JobID = job.ID
+	mutex.Unlock()
+
+	saveCodes()
+	metrics.addRequested(job.Requested)
+	slog.Info("Code redeemed", "code", key, "jobID", job.ID, "requested", job.Requested)
+
+	response := acceptedResponse(job, position, warning)
+	response["code"] = key
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCodesHandlerTicketLimit(t *testing.T) {
+	useTestConfig(t)
+	config.MaxTicketsPerRequest = 20
+	_, routes := newTestRoutes(t)
+
+	w := serve(routes, http.MethodPost, "/api/codes", "application/json", `{"tickets": 21}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("over the limit: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if body := decodeBody(t, w); body["error"] != "At most 20 tickets can be dispensed per request" {
+		t.Errorf("over the limit: error = %v", body["error"])
+	}
+
+	w = serve(routes, http.MethodPost, "/api/codes", "application/json", `{"tickets": 20}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("at the limit: status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	code, _ := decodeBody(t, w)["code"].(string)
+
+	w = serve(routes, http.MethodPost, "/api/redeem", "application/json", `{"code": "`+code+`"}`)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("redeem: status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+}
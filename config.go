@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	// Zone data is built in so timezone works on images without
+	// /usr/share/zoneinfo
+	_ "time/tzdata"
+)
+
+// Config is the effective configuration: defaults, then the -config file,
+// then any command-line flags that were explicitly set.
+type Config struct {
+	// Name is how the machine introduces itself over mDNS and /api/info.
+	Name string `json:"name"`
+	// MDNS advertises the web server on the local network as
+	// MDNSHost.local.
+	MDNS     bool   `json:"mdns"`
+	MDNSHost string `json:"mdnsHost"`
+
+	// Timezone is the IANA zone, such as "America/New_York", that days
+	// start in for the daily cap and the stats. Empty uses the system zone,
+	// which is usually UTC on a Pi.
+	Timezone string `json:"timezone"`
+
+	// Dispensers lists every ticket feeder by name with its own motor and
+	// sensor pin. Left empty, the machine has a single feeder named "main"
+	// on DispenserPin and SensorPin.
+	Dispensers []DispenserConfig `json:"dispensers"`
+
+	DispenserPin  int      `json:"dispenserPin"`
+	SensorPin     int      `json:"sensorPin"`
+	TicketTimeout Duration `json:"ticketTimeout"`
+	MainTimeout   Duration `json:"mainTimeout"`
+	PollInterval  Duration `json:"pollInterval"`
+	Listen        string   `json:"listen"`
+	StaticDir     string   `json:"staticDir"`
+	HistoryFile   string   `json:"historyFile"`
+	MaxQueue      int      `json:"maxQueue"`
+
+	// TLS serves the API and web UI over HTTPS on TLSListen with TLSCert
+	// and TLSKey, generating a self-signed pair if neither exists, and
+	// Listen then only redirects plain HTTP there.
+	TLS       bool   `json:"tls"`
+	TLSListen string `json:"tlsListen"`
+	TLSCert   string `json:"tlsCert"`
+	TLSKey    string `json:"tlsKey"`
+
+	// MaxTicketsPerRequest caps a single dispense. RateLimit is how many
+	// dispense or redeem requests one address may make per minute (0 turns
+	// it off). DailyTicketCap, when set, stops dispensing once that many
+	// tickets have been accepted today until an admin overrides it.
+	MaxTicketsPerRequest int `json:"maxTicketsPerRequest"`
+	RateLimit            int `json:"rateLimit"`
+	DailyTicketCap       int `json:"dailyTicketCap"`
+	// DailyCapWarnPercent is how much of DailyTicketCap, in percent, can be
+	// accepted before the status warns that the cap is close (0 turns the
+	// warning off).
+	DailyCapWarnPercent int `json:"dailyCapWarnPercent"`
+
+	// OperatingHours, such as "09:00-22:00" in Timezone, is when dispenses
+	// are accepted; outside it they are refused unless the request asks
+	// for an admin override. A close before the open runs overnight, and
+	// empty is always open.
+	OperatingHours string `json:"operatingHours"`
+
+	// JamRetries is how many times a stalled feed is stopped for JamBackoff
+	// and restarted before the run is given up as jammed.
+	JamRetries int      `json:"jamRetries"`
+	JamBackoff Duration `json:"jamBackoff"`
+
+	// EmptyRunThreshold consecutive runs without a single sensor edge latch a
+	// dispenser as likely empty, until the sensor moves again or a refill
+	// is recorded. While latched, a run gives up on its first ticket after
+	// EmptyFirstTicketTimeout instead of TicketTimeout, without retrying.
+	EmptyRunThreshold       int      `json:"emptyRunThreshold"`
+	EmptyFirstTicketTimeout Duration `json:"emptyFirstTicketTimeout"`
+
+	// A sensor pulse of at least SplicePulse is the tape join of a spliced
+	// roll rather than a ticket, and isn't counted. The feed tends to
+	// hesitate right after a join, so the next SpliceRelaxTickets tickets
+	// wait SpliceTimeoutFactor times TicketTimeout. SpliceWarnCount splices
+	// in one run raise a warning, since they usually mean the sensor
+	// threshold has drifted.
+	SplicePulse         Duration `json:"splicePulse"`
+	SpliceRelaxTickets  int      `json:"spliceRelaxTickets"`
+	SpliceTimeoutFactor float64  `json:"spliceTimeoutFactor"`
+	SpliceWarnCount     int      `json:"spliceWarnCount"`
+
+	// MotorDrive is "onoff" for a relay that is only switched, or "pwm" to
+	// drive the motor with hardware PWM: every start ramps from
+	// PWMStartDuty to PWMRunDuty over PWMRamp, and the last ticket of a run
+	// feeds at PWMSlowDuty. Duty cycles run from 0 to 1. Jam timeouts are
+	// stretched to match while the motor runs below full speed.
+	MotorDrive   string   `json:"motorDrive"`
+	PWMFrequency int      `json:"pwmFrequency"`
+	PWMStartDuty float64  `json:"pwmStartDuty"`
+	PWMRunDuty   float64  `json:"pwmRunDuty"`
+	PWMSlowDuty  float64  `json:"pwmSlowDuty"`
+	PWMRamp      Duration `json:"pwmRamp"`
+
+	// IdleFeedTickets tickets passing the sensor within IdleFeedWindow with
+	// no run going faults the machine, since the relay must have stuck
+	// closed. 0 turns the watch off. FaultFile keeps a fault across
+	// restarts until it is cleared.
+	IdleFeedTickets int      `json:"idleFeedTickets"`
+	IdleFeedWindow  Duration `json:"idleFeedWindow"`
+	FaultFile       string   `json:"faultFile"`
+
+	// SelfTestPulse is how long POST /api/selftest runs the motor, about
+	// one ticket's worth.
+	SelfTestPulse Duration `json:"selfTestPulse"`
+	// SelfTestAt, such as "07:30" in Timezone, runs the self-test on every
+	// dispenser each day; empty never does. With SelfTestDispense each one
+	// that passes also pays out a single ticket, which is skipped along
+	// with the whole run during QuietHours. SelfTestFile keeps the results
+	// of every self-test across restarts.
+	SelfTestAt       string `json:"selfTestAt"`
+	SelfTestDispense bool   `json:"selfTestDispense"`
+	QuietHours       string `json:"quietHours"`
+	SelfTestFile     string `json:"selfTestFile"`
+
+	// Buttons are physical buttons on the Pi. ButtonDebounce is how long a
+	// level must hold to count, and LongPress how long a maintenance
+	// button is held to toggle maintenance mode.
+	Buttons        []ButtonConfig `json:"buttons"`
+	ButtonDebounce Duration       `json:"buttonDebounce"`
+	LongPress      Duration       `json:"longPress"`
+
+	// SensorActive is the level the sensor reads while a ticket notch is in
+	// front of it: "high" or "low".
+	SensorActive string `json:"sensorActive"`
+	// SensorPull overrides the pull on the sensor input: "up" or "down".
+	// Empty pulls it towards its inactive level.
+	SensorPull string `json:"sensorPull"`
+	// EdgeDetection latches sensor edges in hardware between polls so short
+	// pulses are not missed. Simulation always polls.
+	EdgeDetection bool `json:"edgeDetection"`
+
+	InventoryFile      string `json:"inventoryFile"`
+	LowTicketThreshold int    `json:"lowTicketThreshold"`
+	// InventoryPolicy decides what happens to a request for more tickets
+	// than are left: "warn" accepts it with a warning, "refuse" rejects it.
+	InventoryPolicy string `json:"inventoryPolicy"`
+	// InventoryWarnPercent is how much of the last refill, in percent, can
+	// be left before the status warns that a dispenser is running out (0
+	// turns the warning off).
+	InventoryWarnPercent int `json:"inventoryWarnPercent"`
+
+	// CodesFile keeps redemption codes across restarts. CodeExpiry is how
+	// long a new code stays valid unless the request says otherwise.
+	CodesFile  string   `json:"codesFile"`
+	CodeExpiry Duration `json:"codeExpiry"`
+
+	// PublicStats lists the numbers /stats and /api/public-stats show
+	// without an API key: ticketsToday, ticketsSession, largestPayout and
+	// ticketsPerHour. Empty turns both off.
+	PublicStats []string `json:"publicStats"`
+
+	// MaintenanceFile keeps maintenance mode across restarts.
+	MaintenanceFile string `json:"maintenanceFile"`
+
+	// CleaningTickets is how many tickets a dispenser feeds between roller
+	// cleanings, and ServiceMotorHours how long its motor runs between
+	// services, before a reminder is due; 0 turns one off. ReminderFile
+	// keeps when each was last done.
+	CleaningTickets   int     `json:"cleaningTickets"`
+	ServiceMotorHours float64 `json:"serviceMotorHours"`
+	ReminderFile      string  `json:"reminderFile"`
+
+	// ScheduleFile keeps scheduled dispenses across restarts.
+	ScheduleFile string `json:"scheduleFile"`
+
+	// IdempotencyFile keeps the idempotency keys of accepted dispenses
+	// across restarts, and IdempotencyWindow is how long a key is honoured.
+	IdempotencyFile   string   `json:"idempotencyFile"`
+	IdempotencyWindow Duration `json:"idempotencyWindow"`
+
+	// CORSOrigins may call the API from a browser on another origin. "*"
+	// allows any.
+	CORSOrigins []string `json:"corsOrigins"`
+
+	// APIKeys, when any are set, are required for every mutating endpoint.
+	APIKeys []string `json:"apiKeys"`
+
+	// Webhooks are POSTed a JSON event when a dispense starts, finishes,
+	// jams or times out. WebhookSecret, if set, signs each body.
+	Webhooks      []string `json:"webhooks"`
+	WebhookSecret string   `json:"webhookSecret"`
+
+	// LogLevel is the least severe level logged: debug, info, warn or
+	// error. LogBuffer is how many recent entries /api/logs keeps. LogFile,
+	// if set, also gets every entry as JSON and is rotated to LogFile.1
+	// once it passes LogMaxSize megabytes.
+	LogLevel   string `json:"logLevel"`
+	LogBuffer  int    `json:"logBuffer"`
+	LogFile    string `json:"logFile"`
+	LogMaxSize int64  `json:"logMaxSize"`
+
+	Simulate    bool     `json:"simulate"`
+	SimInterval Duration `json:"simInterval"`
+	SimJamAfter int      `json:"simJamAfter"`
+	// SimStuckRelay makes the simulated motor ignore being switched off,
+	// to exercise the idle watch.
+	SimStuckRelay bool `json:"simStuckRelay"`
+}
+
+// DispenserConfig is one ticket feeder: a motor relay and the sensor that
+// counts its tickets.
+type DispenserConfig struct {
+	Name         string `json:"name"`
+	DispenserPin int    `json:"dispenserPin"`
+	SensorPin    int    `json:"sensorPin"`
+}
+
+// defaultDispenser names the feeder of a machine configured with just
+// dispenserPin and sensorPin.
+const defaultDispenser = "main"
+
+// dispenserConfigs is every configured feeder, first one the default.
+func (c Config) dispenserConfigs() []DispenserConfig {
+	if len(c.Dispensers) > 0 {
+		return c.Dispensers
+	}
+	return []DispenserConfig{{Name: defaultDispenser, DispenserPin: c.DispenserPin, SensorPin: c.SensorPin}}
+}
+
+// buttonDispenser is the feeder a button dispenses from.
+func (c Config) buttonDispenser(b ButtonConfig) string {
+	if b.Dispenser != "" {
+		return b.Dispenser
+	}
+	return c.dispenserConfigs()[0].Name
+}
+
+// Duration is a time.Duration written as a string like "3s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"3s\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// stringList is a comma-separated list flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		Name:     "Ticket Machine",
+		MDNS:     true,
+		MDNSHost: "ticketmachine",
+
+		DispenserPin:  18,
+		SensorPin:     17,
+		TicketTimeout: Duration{3 * time.Second},
+		MainTimeout:   Duration{60 * time.Second},
+		PollInterval:  Duration{5 * time.Millisecond},
+		Listen:        ":8080",
+		StaticDir:     "./static",
+		HistoryFile:   "./history.jsonl",
+		MaxQueue:      10,
+
+		TLSListen: ":8443",
+		TLSCert:   "./cert.pem",
+		TLSKey:    "./key.pem",
+
+		MaxTicketsPerRequest: 100,
+		RateLimit:            10,
+		DailyCapWarnPercent:  80,
+
+		JamRetries: 2,
+		JamBackoff: Duration{500 * time.Millisecond},
+
+		EmptyRunThreshold:       2,
+		EmptyFirstTicketTimeout: Duration{750 * time.Millisecond},
+
+		SplicePulse:         Duration{250 * time.Millisecond},
+		SpliceRelaxTickets:  3,
+		SpliceTimeoutFactor: 2,
+		SpliceWarnCount:     2,
+
+		MotorDrive:   "onoff",
+		PWMFrequency: 10000,
+		PWMStartDuty: 0.3,
+		PWMRunDuty:   1,
+		PWMSlowDuty:  0.4,
+		PWMRamp:      Duration{300 * time.Millisecond},
+
+		IdleFeedTickets: 3,
+		IdleFeedWindow:  Duration{10 * time.Second},
+		FaultFile:       "./fault.json",
+
+		SelfTestPulse: Duration{500 * time.Millisecond},
+		SelfTestFile:  "./selftests.json",
+
+		ButtonDebounce: Duration{50 * time.Millisecond},
+		LongPress:      Duration{3 * time.Second},
+
+		SensorActive:  "high",
+		EdgeDetection: true,
+
+		InventoryFile:        "./inventory.json",
+		LowTicketThreshold:   100,
+		InventoryPolicy:      "warn",
+		InventoryWarnPercent: 20,
+
+		CodesFile:  "./codes.json",
+		CodeExpiry: Duration{24 * time.Hour},
+
+		PublicStats: slices.Clone(publicStatsFields),
+
+		MaintenanceFile: "./maintenance.json",
+
+		CleaningTickets: 50000,
+		ReminderFile:    "./reminders.json",
+
+		ScheduleFile: "./schedules.json",
+
+		IdempotencyFile:   "./idempotency.json",
+		IdempotencyWindow: Duration{24 * time.Hour},
+
+		LogLevel:   "info",
+		LogBuffer:  1000,
+		LogMaxSize: 10,
+
+		SimInterval: Duration{300 * time.Millisecond},
+	}
+}
+
+// bindFlags registers a flag for every overridable setting, writing into c.
+func bindFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Name, "name", c.Name, "name the machine is advertised under")
+	fs.BoolVar(&c.MDNS, "mdns", c.MDNS, "advertise the web server over mDNS")
+	fs.StringVar(&c.MDNSHost, "mdns-host", c.MDNSHost, "host name to answer for, without .local")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "IANA time zone days are counted in, e.g. America/New_York (empty for the system zone)")
+	fs.IntVar(&c.DispenserPin, "dispenser-pin", c.DispenserPin, "BCM pin driving the dispenser motor relay")
+	fs.IntVar(&c.SensorPin, "sensor-pin", c.SensorPin, "BCM pin the ticket sensor is wired to")
+	fs.DurationVar(&c.TicketTimeout.Duration, "ticket-timeout", c.TicketTimeout.Duration, "how long to wait for each ticket before treating the feed as jammed")
+	fs.DurationVar(&c.MainTimeout.Duration, "main-timeout", c.MainTimeout.Duration, "maximum length of a single dispense")
+	fs.IntVar(&c.JamRetries, "jam-retries", c.JamRetries, "times to restart a stalled feed before giving up (0 to never retry)")
+	fs.DurationVar(&c.JamBackoff.Duration, "jam-backoff", c.JamBackoff.Duration, "how long the motor rests before each jam retry")
+	fs.IntVar(&c.EmptyRunThreshold, "empty-run-threshold", c.EmptyRunThreshold, "consecutive runs without a sensor edge before a dispenser is treated as likely empty")
+	fs.DurationVar(&c.EmptyFirstTicketTimeout.Duration, "empty-first-ticket-timeout", c.EmptyFirstTicketTimeout.Duration, "how long a likely empty dispenser waits for its first ticket")
+	fs.DurationVar(&c.SplicePulse.Duration, "splice-pulse", c.SplicePulse.Duration, "shortest sensor pulse taken for a roll splice instead of a ticket")
+	fs.IntVar(&c.SpliceRelaxTickets, "splice-relax-tickets", c.SpliceRelaxTickets, "tickets after a splice that get a longer timeout")
+	fs.Float64Var(&c.SpliceTimeoutFactor, "splice-timeout-factor", c.SpliceTimeoutFactor, "how many times ticket-timeout the tickets after a splice may take")
+	fs.IntVar(&c.SpliceWarnCount, "splice-warn-count", c.SpliceWarnCount, "splices in one run that raise a sensor threshold warning")
+	fs.StringVar(&c.MotorDrive, "motor-drive", c.MotorDrive, "how the motor is driven: onoff, or pwm on a hardware PWM pin")
+	fs.IntVar(&c.PWMFrequency, "pwm-frequency", c.PWMFrequency, "PWM frequency in Hz")
+	fs.Float64Var(&c.PWMStartDuty, "pwm-start-duty", c.PWMStartDuty, "duty cycle (0-1) the motor starts at in PWM mode")
+	fs.Float64Var(&c.PWMRunDuty, "pwm-run-duty", c.PWMRunDuty, "duty cycle (0-1) the motor ramps up to in PWM mode")
+	fs.Float64Var(&c.PWMSlowDuty, "pwm-slow-duty", c.PWMSlowDuty, "duty cycle (0-1) for the last ticket of a run in PWM mode")
+	fs.DurationVar(&c.PWMRamp.Duration, "pwm-ramp", c.PWMRamp.Duration, "how long the motor takes to ramp from the start to the run duty cycle")
+	fs.IntVar(&c.IdleFeedTickets, "idle-feed-tickets", c.IdleFeedTickets, "tickets seen with no run going that fault the machine (0 to not watch)")
+	fs.DurationVar(&c.IdleFeedWindow.Duration, "idle-feed-window", c.IdleFeedWindow.Duration, "window the idle tickets are counted over")
+	fs.StringVar(&c.FaultFile, "fault", c.FaultFile, "file a machine fault is kept in")
+	fs.DurationVar(&c.SelfTestPulse.Duration, "selftest-pulse", c.SelfTestPulse.Duration, "how long a self-test runs the motor")
+	fs.StringVar(&c.SelfTestAt, "selftest-at", c.SelfTestAt, "time of day to self-test every dispenser, e.g. 07:30 (empty for never)")
+	fs.BoolVar(&c.SelfTestDispense, "selftest-dispense", c.SelfTestDispense, "pay out one ticket from each dispenser that passes the daily self-test")
+	fs.StringVar(&c.QuietHours, "quiet-hours", c.QuietHours, "daily window the self-test dispense is too noisy for, e.g. 22:00-08:00 (empty for none)")
+	fs.StringVar(&c.SelfTestFile, "selftests", c.SelfTestFile, "file self-test results are kept in")
+	fs.DurationVar(&c.PollInterval.Duration, "poll-interval", c.PollInterval.Duration, "how often the sensor is sampled while dispensing")
+	fs.DurationVar(&c.ButtonDebounce.Duration, "button-debounce", c.ButtonDebounce.Duration, "how long a button level must hold before it counts")
+	fs.DurationVar(&c.LongPress.Duration, "long-press", c.LongPress.Duration, "how long to hold a maintenance button to toggle maintenance mode")
+	fs.StringVar(&c.SensorActive, "sensor-active", c.SensorActive, "sensor level while a ticket notch is in front of it: high or low")
+	fs.StringVar(&c.SensorPull, "sensor-pull", c.SensorPull, "pull on the sensor input: up, down, or empty for towards its inactive level")
+	fs.BoolVar(&c.EdgeDetection, "edge-detection", c.EdgeDetection, "latch sensor edges in hardware between polls")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the web server listens on")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "serve HTTPS on -tls-listen and redirect -listen to it")
+	fs.StringVar(&c.TLSListen, "tls-listen", c.TLSListen, "address the HTTPS server listens on")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file, generated self-signed if it and the key are missing")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "directory of files that override the built-in web UI, if it exists")
+	fs.StringVar(&c.HistoryFile, "history", c.HistoryFile, "file dispense history is appended to")
+	fs.IntVar(&c.MaxQueue, "max-queue", c.MaxQueue, "maximum number of dispenses waiting in the queue")
+	fs.IntVar(&c.MaxTicketsPerRequest, "max-tickets", c.MaxTicketsPerRequest, "most tickets a single request may ask for")
+	fs.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "dispense requests allowed per address per minute (0 for no limit)")
+	fs.IntVar(&c.DailyTicketCap, "daily-cap", c.DailyTicketCap, "tickets allowed per day before an admin override is needed (0 for no cap)")
+	fs.IntVar(&c.DailyCapWarnPercent, "daily-cap-warn", c.DailyCapWarnPercent, "percent of the daily cap accepted before the status warns it is close (0 for no warning)")
+	fs.StringVar(&c.OperatingHours, "operating-hours", c.OperatingHours, "daily window dispenses are accepted in, e.g. 09:00-22:00 (empty for always)")
+	fs.StringVar(&c.InventoryFile, "inventory", c.InventoryFile, "file the ticket inventory is kept in")
+	fs.IntVar(&c.LowTicketThreshold, "low-ticket-threshold", c.LowTicketThreshold, "remaining tickets below which the machine reports low")
+	fs.StringVar(&c.InventoryPolicy, "inventory-policy", c.InventoryPolicy, "what to do with requests larger than the remaining tickets: warn or refuse")
+	fs.IntVar(&c.InventoryWarnPercent, "inventory-warn", c.InventoryWarnPercent, "percent of the last refill left before the status warns a dispenser is running out (0 for no warning)")
+	fs.StringVar(&c.CodesFile, "codes", c.CodesFile, "file redemption codes are kept in")
+	fs.DurationVar(&c.CodeExpiry.Duration, "code-expiry", c.CodeExpiry.Duration, "how long a new redemption code stays valid")
+	fs.Var((*stringList)(&c.PublicStats), "public-stats", "comma-separated numbers the public stats page shows: "+strings.Join(publicStatsFields, ", "))
+	fs.StringVar(&c.MaintenanceFile, "maintenance", c.MaintenanceFile, "file maintenance mode is kept in")
+	fs.IntVar(&c.CleaningTickets, "cleaning-tickets", c.CleaningTickets, "tickets a dispenser feeds before its rollers are due a cleaning (0 for no reminder)")
+	fs.Float64Var(&c.ServiceMotorHours, "service-motor-hours", c.ServiceMotorHours, "motor hours before a dispenser is due a service (0 for no reminder)")
+	fs.StringVar(&c.ReminderFile, "reminders", c.ReminderFile, "file the last cleaning and service of each dispenser are kept in")
+	fs.StringVar(&c.ScheduleFile, "schedules", c.ScheduleFile, "file scheduled dispenses are kept in")
+	fs.StringVar(&c.IdempotencyFile, "idempotency", c.IdempotencyFile, "file idempotency keys of accepted dispenses are kept in")
+	fs.DurationVar(&c.IdempotencyWindow.Duration, "idempotency-window", c.IdempotencyWindow.Duration, "how long a repeated idempotency key returns the original dispense")
+	fs.Var((*stringList)(&c.CORSOrigins), "cors-origins", "comma-separated origins allowed to call the API from a browser (* for any)")
+	fs.Var((*stringList)(&c.APIKeys), "api-keys", "comma-separated API keys required for mutating endpoints")
+	fs.Var((*stringList)(&c.Webhooks), "webhooks", "comma-separated URLs to POST dispense events to")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "secret for the HMAC-SHA256 signature on webhook bodies")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least severe level to log: debug, info, warn or error")
+	fs.IntVar(&c.LogBuffer, "log-buffer", c.LogBuffer, "recent log entries kept for /api/logs")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "file to also write JSON logs to (empty for none)")
+	fs.Int64Var(&c.LogMaxSize, "log-max-size", c.LogMaxSize, "megabytes the log file may reach before it is rotated")
+	fs.BoolVar(&c.Simulate, "simulate", c.Simulate, "run against simulated hardware instead of GPIO (or set TICKET_MACHINE_SIMULATE=1)")
+	fs.DurationVar(&c.SimInterval.Duration, "sim-interval", c.SimInterval.Duration, "time between simulated tickets")
+	fs.IntVar(&c.SimJamAfter, "sim-jam-after", c.SimJamAfter, "simulate a jam after this many tickets (0 never jams)")
+	fs.BoolVar(&c.SimStuckRelay, "sim-stuck-relay", c.SimStuckRelay, "simulate a motor relay that sticks on once started")
+}
+
+// loadConfig parses the command line, reads the config file if one was
+// given and applies explicitly set flags on top of it.
+func loadConfig() (Config, error) {
+	parsed := defaultConfig()
+	configPath := flag.String("config", "", "path to a JSON config file")
+	bindFlags(flag.CommandLine, &parsed)
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config: %w", err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", *configPath, err)
+		}
+	}
+
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bindFlags(overrides, &cfg)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			overrides.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if sim, _ := strconv.ParseBool(os.Getenv("TICKET_MACHINE_SIMULATE")); sim {
+		cfg.Simulate = true
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports every problem with the configuration at once.
+func (c Config) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(c.Name) == "" {
+		errs = append(errs, errors.New("name must be set"))
+	}
+	if c.MDNS && !validHostLabel(c.MDNSHost) {
+		errs = append(errs, fmt.Errorf("mdnsHost %q must be a single DNS label of letters, digits and hyphens", c.MDNSHost))
+	}
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("timezone %q is not a known time zone", c.Timezone))
+		}
+	}
+	// A machine without a dispensers list reports problems against the
+	// top-level pins it was configured with
+	usedPins := map[int]string{}
+	names := map[string]bool{}
+	for i, d := range c.dispenserConfigs() {
+		prefix := ""
+		if len(c.Dispensers) > 0 {
+			prefix = fmt.Sprintf("dispensers[%d].", i)
+			if !validHostLabel(d.Name) {
+				errs = append(errs, fmt.Errorf("%sname %q must be letters, digits and hyphens", prefix, d.Name))
+			} else if names[d.Name] {
+				errs = append(errs, fmt.Errorf("%sname %q is used by another dispenser", prefix, d.Name))
+			}
+		}
+		names[d.Name] = true
+
+		for _, pin := range []struct {
+			field string
+			pin   int
+		}{{prefix + "dispenserPin", d.DispenserPin}, {prefix + "sensorPin", d.SensorPin}} {
+			if !validBCMPin(pin.pin) {
+				errs = append(errs, fmt.Errorf("%s %d is not a BCM GPIO pin (0-27)", pin.field, pin.pin))
+			} else if other, taken := usedPins[pin.pin]; taken {
+				errs = append(errs, fmt.Errorf("%s %d is already used by %s", pin.field, pin.pin, other))
+			} else {
+				usedPins[pin.pin] = pin.field
+			}
+		}
+	}
+	if c.TicketTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("ticketTimeout must be greater than zero"))
+	}
+	if c.MainTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("mainTimeout must be greater than zero"))
+	}
+	if c.JamRetries < 0 {
+		errs = append(errs, errors.New("jamRetries cannot be negative"))
+	}
+	if c.JamRetries > 0 && c.JamBackoff.Duration <= 0 {
+		errs = append(errs, errors.New("jamBackoff must be greater than zero"))
+	}
+	if c.EmptyRunThreshold < 1 {
+		errs = append(errs, errors.New("emptyRunThreshold must be at least 1"))
+	}
+	if c.EmptyFirstTicketTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("emptyFirstTicketTimeout must be greater than zero"))
+	} else if c.TicketTimeout.Duration > 0 && c.EmptyFirstTicketTimeout.Duration > c.TicketTimeout.Duration {
+		errs = append(errs, fmt.Errorf("emptyFirstTicketTimeout %s is longer than ticketTimeout %s", c.EmptyFirstTicketTimeout, c.TicketTimeout))
+	}
+	// A ticket's pulse runs from a single poll, for a torn or fast ticket,
+	// up to just under the splice threshold, and a join has to pass before
+	// the wait for the next ticket runs out
+	if c.SplicePulse.Duration <= 0 {
+		errs = append(errs, errors.New("splicePulse must be greater than zero"))
+	} else {
+		if c.PollInterval.Duration > 0 && c.SplicePulse.Duration <= 2*c.PollInterval.Duration {
+			errs = append(errs, fmt.Errorf("splicePulse %s must be longer than two pollIntervals (%s), or every ticket could be taken for a splice", c.SplicePulse, c.PollInterval))
+		}
+		if c.TicketTimeout.Duration > 0 && c.SplicePulse.Duration >= c.TicketTimeout.Duration {
+			errs = append(errs, fmt.Errorf("splicePulse %s must be shorter than ticketTimeout %s, or a splice would always be taken for a jam", c.SplicePulse, c.TicketTimeout))
+		}
+		if c.Simulate && c.SimInterval.Duration > 0 && simPulseWidth(c.SimInterval.Duration) >= c.SplicePulse.Duration {
+			errs = append(errs, fmt.Errorf("splicePulse %s must be longer than the %s pulse of a simulated ticket", c.SplicePulse, simPulseWidth(c.SimInterval.Duration)))
+		}
+	}
+	if c.SpliceRelaxTickets < 0 {
+		errs = append(errs, errors.New("spliceRelaxTickets cannot be negative"))
+	}
+	if c.SpliceTimeoutFactor < 1 {
+		errs = append(errs, errors.New("spliceTimeoutFactor must be at least 1"))
+	}
+	if c.SpliceWarnCount < 1 {
+		errs = append(errs, errors.New("spliceWarnCount must be at least 1"))
+	}
+	switch c.MotorDrive {
+	case "onoff":
+	case "pwm":
+		// Pins 12 and 18 share one PWM channel and 13 and 19 the other, so
+		// two motors on one channel would always run at the same speed
+		channels := map[int]string{}
+		for i, d := range c.dispenserConfigs() {
+			field := "dispenserPin"
+			if len(c.Dispensers) > 0 {
+				field = fmt.Sprintf("dispensers[%d].dispenserPin", i)
+			}
+			channel, ok := pwmChannel(d.DispenserPin)
+			if !ok {
+				if !c.Simulate {
+					errs = append(errs, fmt.Errorf("%s %d has no hardware PWM; use 12, 13, 18 or 19, or motorDrive \"onoff\"", field, d.DispenserPin))
+				}
+				continue
+			}
+			if other, taken := channels[channel]; taken {
+				errs = append(errs, fmt.Errorf("%s %d shares a PWM channel with %s", field, d.DispenserPin, other))
+			}
+			channels[channel] = field
+		}
+		if clock := c.PWMFrequency * pwmCycle; clock < 4688 || clock > 19_200_000 {
+			errs = append(errs, fmt.Errorf("pwmFrequency must be between %d and %d Hz", (4688+pwmCycle-1)/pwmCycle, 19_200_000/pwmCycle))
+		}
+		for _, duty := range []struct {
+			field string
+			value float64
+		}{{"pwmStartDuty", c.PWMStartDuty}, {"pwmRunDuty", c.PWMRunDuty}, {"pwmSlowDuty", c.PWMSlowDuty}} {
+			if duty.value <= 0 || duty.value > 1 {
+				errs = append(errs, fmt.Errorf("%s %v must be above 0 and at most 1", duty.field, duty.value))
+			}
+		}
+		if c.PWMStartDuty > c.PWMRunDuty {
+			errs = append(errs, errors.New("pwmStartDuty must not be above pwmRunDuty"))
+		}
+		if c.PWMRamp.Duration < 0 {
+			errs = append(errs, errors.New("pwmRamp cannot be negative"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("motorDrive %q must be \"onoff\" or \"pwm\"", c.MotorDrive))
+	}
+	if c.IdleFeedTickets < 0 {
+		errs = append(errs, errors.New("idleFeedTickets cannot be negative"))
+	}
+	if c.IdleFeedTickets > 0 && c.IdleFeedWindow.Duration <= 0 {
+		errs = append(errs, errors.New("idleFeedWindow must be greater than zero"))
+	}
+	if c.FaultFile == "" {
+		errs = append(errs, errors.New("faultFile must be set"))
+	}
+	if c.SelfTestPulse.Duration <= 0 {
+		errs = append(errs, errors.New("selfTestPulse must be greater than zero"))
+	} else if c.MainTimeout.Duration > 0 && c.SelfTestPulse.Duration > c.MainTimeout.Duration {
+		errs = append(errs, fmt.Errorf("selfTestPulse %s is longer than mainTimeout %s", c.SelfTestPulse, c.MainTimeout))
+	}
+	if c.SelfTestAt != "" {
+		if _, err := parseClockTime(c.SelfTestAt); err != nil {
+			errs = append(errs, fmt.Errorf("selfTestAt %q must look like 07:30", c.SelfTestAt))
+		}
+	}
+	if c.QuietHours != "" {
+		if _, err := parseOperatingHours(c.QuietHours); err != nil {
+			errs = append(errs, fmt.Errorf("quietHours %v", err))
+		}
+	}
+	if c.SelfTestFile == "" {
+		errs = append(errs, errors.New("selfTestFile must be set"))
+	}
+	if c.PollInterval.Duration <= 0 {
+		errs = append(errs, errors.New("pollInterval must be greater than zero"))
+	} else if c.TicketTimeout.Duration > 0 && c.PollInterval.Duration >= c.TicketTimeout.Duration {
+		errs = append(errs, fmt.Errorf("pollInterval %s must be shorter than ticketTimeout %s", c.PollInterval, c.TicketTimeout))
+	}
+	if c.MainTimeout.Duration > 0 && c.TicketTimeout.Duration > c.MainTimeout.Duration {
+		errs = append(errs, fmt.Errorf("ticketTimeout %s is longer than mainTimeout %s", c.TicketTimeout, c.MainTimeout))
+	}
+	for i, b := range c.Buttons {
+		if !validBCMPin(b.Pin) {
+			errs = append(errs, fmt.Errorf("buttons[%d].pin %d is not a BCM GPIO pin (0-27)", i, b.Pin))
+		} else if other, taken := usedPins[b.Pin]; taken {
+			errs = append(errs, fmt.Errorf("buttons[%d].pin %d is already used by %s", i, b.Pin, other))
+		} else {
+			usedPins[b.Pin] = fmt.Sprintf("buttons[%d]", i)
+		}
+		if b.Tickets < 0 || b.Tickets > c.MaxTicketsPerRequest {
+			errs = append(errs, fmt.Errorf("buttons[%d].tickets must be between 0 and maxTicketsPerRequest", i))
+		}
+		if b.Tickets == 0 && !b.Maintenance {
+			errs = append(errs, fmt.Errorf("buttons[%d] neither dispenses tickets nor toggles maintenance", i))
+		}
+		if b.Dispenser != "" && !names[b.Dispenser] {
+			errs = append(errs, fmt.Errorf("buttons[%d].dispenser %q is not a configured dispenser", i, b.Dispenser))
+		}
+	}
+	if len(c.Buttons) > 0 {
+		if c.ButtonDebounce.Duration <= 0 {
+			errs = append(errs, errors.New("buttonDebounce must be greater than zero"))
+		}
+		if c.LongPress.Duration <= c.ButtonDebounce.Duration {
+			errs = append(errs, errors.New("longPress must be longer than buttonDebounce"))
+		}
+	}
+	if c.SensorActive != "high" && c.SensorActive != "low" {
+		errs = append(errs, fmt.Errorf("sensorActive %q must be \"high\" or \"low\"", c.SensorActive))
+	}
+	if c.SensorPull != "" && c.SensorPull != "up" && c.SensorPull != "down" {
+		errs = append(errs, fmt.Errorf("sensorPull %q must be \"up\", \"down\" or empty", c.SensorPull))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen %q: %v", c.Listen, err))
+	}
+	if c.TLS {
+		if _, _, err := net.SplitHostPort(c.TLSListen); err != nil {
+			errs = append(errs, fmt.Errorf("tlsListen %q: %v", c.TLSListen, err))
+		} else if c.TLSListen == c.Listen {
+			errs = append(errs, fmt.Errorf("tlsListen and listen are both %q", c.Listen))
+		}
+		if c.TLSCert == "" || c.TLSKey == "" {
+			errs = append(errs, errors.New("tlsCert and tlsKey must be set when tls is on"))
+		}
+	}
+	if c.HistoryFile == "" {
+		errs = append(errs, errors.New("historyFile must be set"))
+	}
+	if c.MaxQueue < 1 {
+		errs = append(errs, errors.New("maxQueue must be at least 1"))
+	}
+	if c.MaxTicketsPerRequest < 1 {
+		errs = append(errs, errors.New("maxTicketsPerRequest must be at least 1"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, errors.New("rateLimit cannot be negative"))
+	}
+	if c.DailyTicketCap < 0 {
+		errs = append(errs, errors.New("dailyTicketCap cannot be negative"))
+	}
+	// The cap itself is 100%, and the warning has to come before it
+	if c.DailyCapWarnPercent < 0 || c.DailyCapWarnPercent >= 100 {
+		errs = append(errs, errors.New("dailyCapWarnPercent must be from 0 to 99"))
+	}
+	if c.OperatingHours != "" {
+		if _, err := parseOperatingHours(c.OperatingHours); err != nil {
+			errs = append(errs, fmt.Errorf("operatingHours %v", err))
+		}
+	}
+	if c.InventoryFile == "" {
+		errs = append(errs, errors.New("inventoryFile must be set"))
+	}
+	if c.LowTicketThreshold < 0 {
+		errs = append(errs, errors.New("lowTicketThreshold cannot be negative"))
+	}
+	if c.InventoryPolicy != "warn" && c.InventoryPolicy != "refuse" {
+		errs = append(errs, fmt.Errorf("inventoryPolicy %q must be \"warn\" or \"refuse\"", c.InventoryPolicy))
+	}
+	// A full refill is 100% and running dry 0%, and the warning has to
+	// come between them
+	if c.InventoryWarnPercent < 0 || c.InventoryWarnPercent >= 100 {
+		errs = append(errs, errors.New("inventoryWarnPercent must be from 0 to 99"))
+	}
+	if c.CodesFile == "" {
+		errs = append(errs, errors.New("codesFile must be set"))
+	}
+	if c.CodeExpiry.Duration <= 0 {
+		errs = append(errs, errors.New("codeExpiry must be greater than zero"))
+	}
+	for i, field := range c.PublicStats {
+		if !slices.Contains(publicStatsFields, field) {
+			errs = append(errs, fmt.Errorf("publicStats[%d] %q must be one of %s", i, field, strings.Join(publicStatsFields, ", ")))
+		}
+	}
+	if c.MaintenanceFile == "" {
+		errs = append(errs, errors.New("maintenanceFile must be set"))
+	}
+	if c.CleaningTickets < 0 {
+		errs = append(errs, errors.New("cleaningTickets cannot be negative"))
+	}
+	if c.ServiceMotorHours < 0 {
+		errs = append(errs, errors.New("serviceMotorHours cannot be negative"))
+	}
+	if c.ReminderFile == "" {
+		errs = append(errs, errors.New("reminderFile must be set"))
+	}
+	if c.ScheduleFile == "" {
+		errs = append(errs, errors.New("scheduleFile must be set"))
+	}
+	if c.IdempotencyFile == "" {
+		errs = append(errs, errors.New("idempotencyFile must be set"))
+	}
+	if c.IdempotencyWindow.Duration <= 0 {
+		errs = append(errs, errors.New("idempotencyWindow must be greater than zero"))
+	}
+	for i, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("corsOrigins[%d] %q must be an origin like https://kiosk.example.com", i, origin))
+		}
+	}
+	for i, key := range c.APIKeys {
+		if strings.TrimSpace(key) == "" {
+			errs = append(errs, fmt.Errorf("apiKeys[%d] is empty", i))
+		}
+	}
+	for i, hook := range c.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhooks[%d] %q must be an http or https URL", i, hook))
+		}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel %q must be debug, info, warn or error", c.LogLevel))
+	}
+	if c.LogBuffer < 1 {
+		errs = append(errs, errors.New("logBuffer must be at least 1"))
+	}
+	if c.LogFile != "" && c.LogMaxSize < 1 {
+		errs = append(errs, errors.New("logMaxSize must be at least 1"))
+	}
+	if c.Simulate && c.SimInterval.Duration <= 0 {
+		errs = append(errs, errors.New("simInterval must be greater than zero"))
+	}
+	if c.SimJamAfter < 0 {
+		errs = append(errs, errors.New("simJamAfter cannot be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// pwmChannel is the hardware PWM channel a BCM pin can drive.
+func pwmChannel(pin int) (int, bool) {
+	switch pin {
+	case 12, 18:
+		return 0, true
+	case 13, 19:
+		return 1, true
+	}
+	return 0, false
+}
+
+func validBCMPin(pin int) bool {
+	return pin >= 0 && pin <= 27
+}
+
+func validHostLabel(label string) bool {
+	if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return false
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	// The config endpoint is open, so never hand out the keys themselves
+	effective := config
+	effective.APIKeys = make([]string, len(config.APIKeys))
+	for i := range effective.APIKeys {
+		effective.APIKeys[i] = "********"
+	}
+	if effective.WebhookSecret != "" {
+		effective.WebhookSecret = "********"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effective)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSplice(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no threshold", func(c *Config) { c.SplicePulse = Duration{} }, "splicePulse must be greater than zero"},
+		{"within the poll resolution", func(c *Config) { c.SplicePulse = Duration{8 * time.Millisecond} }, "must be longer than two pollIntervals"},
+		{"past the ticket timeout", func(c *Config) { c.SplicePulse = Duration{3 * time.Second} }, "must be shorter than ticketTimeout"},
+		{"as long as a simulated ticket", func(c *Config) {
+			c.Simulate = true
+			c.SplicePulse = Duration{20 * time.Millisecond}
+		}, "must be longer than the 20ms pulse of a simulated ticket"},
+		{"negative relax", func(c *Config) { c.SpliceRelaxTickets = -1 }, "spliceRelaxTickets cannot be negative"},
+		{"timeout shortened", func(c *Config) { c.SpliceTimeoutFactor = 0.5 }, "spliceTimeoutFactor must be at least 1"},
+		{"never warns", func(c *Config) { c.SpliceWarnCount = 0 }, "spliceWarnCount must be at least 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.change(&c)
+
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Stalls tell apart the two ways a feed goes quiet: a run whose sensor never
+// fired at all is most likely out of tickets, while one that fed some and
+// then stopped is jammed.
+const (
+	stallOutOfTickets = "out_of_tickets"
+	stallMidRun       = "jammed_mid_run"
+)
+
+// Reasons a dispense stops short, returned by Dispense alongside its Result.
+var (
+	errBusy         = errors.New("dispenser is already running")
+	errCancelled    = errors.New("dispense cancelled")
+	errShuttingDown = errors.New("ticket machine is shutting down")
+	errEmpty        = errors.New("machine appears empty")
+	errJammed       = errors.New("no ticket detected, dispenser may be jammed or out of tickets")
+	errTimedOut     = errors.New("dispense did not finish within the main timeout")
+)
+
+// Dispenser is one ticket feeder: the motor and sensor behind hw, the queue
+// of jobs waiting for it and what it is doing right now. Each dispenser runs
+// its own jobs, so several can feed at once. Apart from Name and hw, its
+// fields are guarded by mutex, which also covers the machine-wide state its
+// runs touch.
+type Dispenser struct {
+	Name string
+	hw   Hardware
+
+	dispensing bool
+	// status is the message of the last event, for the status line.
+	status string
+	// cancel stops the running dispense. It is nil whenever nothing is
+	// dispensing.
+	cancel context.CancelCauseFunc
+
+	// emptyStreak counts consecutive runs that ended without a single sensor
+	// edge; once it reaches config.EmptyRunThreshold the feeder is latched as
+	// likely empty until the sensor moves again.
+	emptyStreak int
+	likelyEmpty bool
+
+	// queue holds jobs waiting for the dispenser, next to run first, and
+	// current is the one running or the last to finish.
+	queue   []*Job
+	current *Job
+
+	// wake nudges the worker when a job is added to an empty queue, and done
+	// is closed once the worker has finished its last job.
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newDispenser(name string, hw Hardware) *Dispenser {
+	return &Dispenser{
+		Name: name,
+		hw:   hw,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// Result is what a single dispense run achieved.
+type Result struct {
+	Requested  int
+	Dispensed  int
+	JamRetries int
+	Splices    int
+	// Outcome is the job state the run ended in, and Stall how the feed went
+	// quiet when it ended jammed.
+	Outcome string
+	Stall   string
+}
+
+// DispenserStatus is a snapshot of one dispenser for /api/status and the
+// event stream.
+type DispenserStatus struct {
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	IsDispensing bool   `json:"isDispensing"`
+	LikelyEmpty  bool   `json:"likelyEmpty"`
+	JobID        string `json:"jobId,omitempty"`
+	// Requested, Dispensed and Outcome describe the running job, or the last
+	// one to finish, so clients don't have to parse Status.
+	Requested int    `json:"requested,omitempty"`
+	Dispensed int    `json:"dispensed,omitempty"`
+	Outcome   string `json:"outcome,omitempty"`
+	Stall     string `json:"stall,omitempty"`
+	Queued    int    `json:"queued"`
+	Pending   int    `json:"ticketsPending"`
+	Remaining *int   `json:"ticketsRemaining,omitempty"`
+	LowTicket bool   `json:"lowTicket"`
+}
+
+// Status snapshots the dispenser.
+func (d *Dispenser) Status() DispenserStatus {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return d.snapshot()
+}
+
+// snapshot is Status for callers that already hold mutex.
+func (d *Dispenser) snapshot() DispenserStatus {
+	s := DispenserStatus{
+		Name:         d.Name,
+		Status:       d.status,
+		IsDispensing: d.dispensing,
+		LikelyEmpty:  d.likelyEmpty,
+		Queued:       len(d.queue),
+		Pending:      d.pendingTickets(),
+	}
+	if d.current != nil {
+		s.JobID = d.current.ID
+		s.Requested = d.current.Requested
+		s.Dispensed = d.current.Dispensed
+		s.Outcome = d.current.State
+		s.Stall = d.current.Stall
+	}
+	if inv := inventory[d.Name]; inv.Known {
+		s.Remaining = &inv.Remaining
+		s.LowTicket = d.lowOnTickets()
+	}
+	return s
+}
+
+// event records something the dispenser did. It is logged at level with the
+// dispenser, the job it is running and args as fields, and msg becomes the
+// status line. The caller must hold mutex.
+func (d *Dispenser) event(level slog.Level, msg string, args ...any) {
+	d.status = msg
+	statusChanged()
+
+	fields := []any{"dispenser", d.Name}
+	if d.current != nil && d.current.FinishedAt == nil {
+		fields = append(fields, "jobID", d.current.ID)
+	}
+	slog.Log(context.Background(), level, msg, append(fields, args...)...)
+}
+
+// Cancel stops the running dispense and reports whether there was one.
+func (d *Dispenser) Cancel() bool {
+	mutex.Lock()
+	stopped := d.stop("Cancelling...")
+	statusChanged()
+	mutex.Unlock()
+
+	// Stop the motor right away rather than waiting for the dispense loop
+	// to notice the cancellation on its next pass.
+	if stopped {
+		d.hw.SetLow()
+	}
+	return stopped
+}
+
+// stop asks the running dispense to stop and reports whether one was
+// running. The caller must hold mutex and should stop the motor once it has
+// released it.
+func (d *Dispenser) stop(message string) bool {
+	if !d.dispensing || d.cancel == nil {
+		return false
+	}
+
+	d.cancel(errCancelled)
+	d.event(slog.LevelInfo, message)
+	return true
+}
+
+// clearEmpty forgets that the feeder looked empty, e.g. after a refill. The
+// caller must hold mutex.
+func (d *Dispenser) clearEmpty() {
+	d.emptyStreak = 0
+	d.likelyEmpty = false
+}
+
+// Dispense feeds n tickets, counting them at the sensor, until they are all
+// out, the feed stalls beyond its jam retries, the main timeout passes or
+// ctx is done. A ctx cancelled with errShuttingDown as its cause ends the
+// run as interrupted rather than cancelled. The error is nil only when all
+// n tickets were dispensed.
+func (d *Dispenser) Dispense(ctx context.Context, n int) (Result, error) {
+	result := Result{Requested: n}
+
+	mutex.Lock()
+	if d.dispensing {
+		mutex.Unlock()
+		return result, errBusy
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	d.dispensing = true
+	d.cancel = cancel
+	d.event(slog.LevelInfo, fmt.Sprintf("Dispensing %d ticket(s)...", n), "requested", n)
+	mutex.Unlock()
+
+	// However the run ends, even by panic, a dispenser left marked as
+	// running would never take another job.
+	defer func() {
+		mutex.Lock()
+		d.dispensing = false
+		d.cancel = nil
+		statusChanged()
+		mutex.Unlock()
+	}()
+
+	d.hw.SetLow()
+	clock.Sleep(100 * time.Millisecond)
+
+	sensor := newSensorWatcher(d.hw)
+	defer sensor.stop()
+
+	motor := newMotorRamp(ctx, d.hw)
+	if n == 1 {
+		motor.setSlow()
+	}
+	if ctx.Err() == nil {
+		motor.start()
+	}
+
+	mutex.Lock()
+	d.event(slog.LevelDebug, "Dispenser activated")
+	mutex.Unlock()
+
+	startTime := clock.Now()
+	mainTimeout := config.MainTimeout.Duration
+
+	ticketTimeout := config.TicketTimeout.Duration
+	lastTicketTime := clock.Now()
+
+	// If the last few runs never saw the sensor move, don't spin the motor
+	// for the full timeout waiting on a first ticket that isn't there.
+	mutex.Lock()
+	firstTicketTimeout := ticketTimeout
+	likelyEmptyAtStart := d.likelyEmpty
+	if likelyEmptyAtStart {
+		firstTicketTimeout = config.EmptyFirstTicketTimeout.Duration
+	}
+	statusChanged()
+	mutex.Unlock()
+	sawEdge := false
+	// lastEdge is when the sensor last moved at all. Unlike lastTicketTime
+	// it isn't reset by a jam retry, so it measures how long the sensor has
+	// really been silent.
+	lastEdge := startTime
+
+	var pulseStart time.Time
+	relaxRemaining := 0
+
+	for ctx.Err() == nil && result.Dispensed < n && since(startTime) < mainTimeout {
+		motor.update()
+		for _, active := range sensor.poll() {
+			lastEdge = clock.Now()
+			if !sawEdge {
+				sawEdge = true
+				mutex.Lock()
+				d.clearEmpty()
+				statusChanged()
+				mutex.Unlock()
+			}
+
+			if active {
+				pulseStart = clock.Now()
+				continue
+			}
+			if pulseStart.IsZero() {
+				continue
+			}
+
+			// A ticket is counted on the trailing edge, once its pulse has
+			// fully passed the sensor, so the pulse width can be checked
+			// against the splice threshold first
+			if pulse := since(pulseStart); pulse >= config.SplicePulse.Duration {
+				result.Splices++
+				relaxRemaining = config.SpliceRelaxTickets
+
+				mutex.Lock()
+				if d.current != nil {
+					d.current.Splices = result.Splices
+				}
+				if result.Splices >= config.SpliceWarnCount {
+					d.event(slog.LevelWarn, fmt.Sprintf("Warning: %d splices detected in one run. Sensor threshold may have drifted", result.Splices),
+						"splices", result.Splices, "pulse", pulse)
+				} else {
+					d.event(slog.LevelInfo, fmt.Sprintf("Splice passed after ticket %d/%d", result.Dispensed, n),
+						"ticketsDispensed", result.Dispensed, "pulse", pulse)
+				}
+				mutex.Unlock()
+			} else {
+				result.Dispensed++
+				if relaxRemaining > 0 {
+					relaxRemaining--
+				}
+				motor.ticketFed()
+				if result.Dispensed == n-1 {
+					motor.setSlow()
+				}
+				interval := since(lastTicketTime)
+				metrics.ticketFed(interval)
+
+				mutex.Lock()
+				if d.current != nil {
+					d.current.Dispensed = result.Dispensed
+				}
+				d.takeTicket()
+				d.event(slog.LevelDebug, fmt.Sprintf("Ticket %d/%d dispensed", result.Dispensed, n),
+					"ticketsDispensed", result.Dispensed, "interval", interval)
+				mutex.Unlock()
+			}
+
+			pulseStart = time.Time{}
+			lastTicketTime = clock.Now()
+			if result.Dispensed >= n {
+				break
+			}
+		}
+
+		clock.Sleep(config.PollInterval.Duration)
+
+		timeout := ticketTimeout
+		if !sawEdge {
+			timeout = firstTicketTimeout
+		} else if relaxRemaining > 0 {
+			timeout = time.Duration(float64(ticketTimeout) * config.SpliceTimeoutFactor)
+		}
+		timeout = motor.timeout(timeout)
+
+		if result.Dispensed < n &&
+			since(lastTicketTime) > timeout {
+			// A short rest and a fresh start usually clears a hiccup in the
+			// feed. A machine that already looks empty isn't worth retrying.
+			if result.JamRetries < config.JamRetries && (sawEdge || !likelyEmptyAtStart) {
+				result.JamRetries++
+
+				mutex.Lock()
+				if d.current != nil {
+					d.current.JamRetries = result.JamRetries
+				}
+				d.event(slog.LevelWarn, fmt.Sprintf("Jam detected, retry %d/%d...", result.JamRetries, config.JamRetries),
+					"ticketsDispensed", result.Dispensed, "jamRetries", result.JamRetries, "sinceLastTicket", since(lastTicketTime))
+				mutex.Unlock()
+
+				motor.stop()
+				backoff := min(config.JamBackoff.Duration, mainTimeout-since(startTime))
+				if backoff <= 0 {
+					break
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-clock.After(backoff):
+				}
+				if ctx.Err() != nil {
+					break
+				}
+
+				motor.start()
+				lastTicketTime = clock.Now()
+				continue
+			}
+
+			mutex.Lock()
+			d.event(slog.LevelWarn, "Warning: No ticket detected for a while. Dispenser may be jammed or out of tickets",
+				"ticketsDispensed", result.Dispensed, "sinceLastTicket", since(lastTicketTime))
+			mutex.Unlock()
+			break
+		}
+	}
+
+	motor.stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stopped := context.Cause(ctx)
+	if !sawEdge && stopped == nil {
+		d.emptyStreak++
+		if d.emptyStreak >= config.EmptyRunThreshold {
+			d.likelyEmpty = true
+		}
+	}
+
+	var err error
+	var status string
+	level := slog.LevelWarn
+	switch {
+	case errors.Is(stopped, errShuttingDown):
+		result.Outcome, err = jobInterrupted, errShuttingDown
+		status = fmt.Sprintf("Interrupted by shutdown after %d/%d tickets", result.Dispensed, n)
+	case stopped != nil:
+		result.Outcome, err = jobCancelled, errCancelled
+		status = fmt.Sprintf("Cancelled after %d/%d tickets", result.Dispensed, n)
+		level = slog.LevelInfo
+	case result.Dispensed == n:
+		result.Outcome = jobDone
+		status = fmt.Sprintf("Successfully dispensed %d ticket(s)", n)
+		level = slog.LevelInfo
+	case d.likelyEmpty:
+		result.Outcome, err = jobJammed, errEmpty
+		result.Stall = stallOutOfTickets
+		status = "Machine appears empty — reload tickets"
+	case since(startTime) >= mainTimeout:
+		// Tickets are counted on the trailing edge, so every one counted has
+		// fully left the feeder
+		result.Outcome, err = jobTimeout, errTimedOut
+		status = fmt.Sprintf("Dispensing stopped after %d/%d tickets.\nCheck if machine is empty or is not feeding. Operation timed out", result.Dispensed, n)
+	case !sawEdge:
+		result.Outcome, err = jobJammed, errJammed
+		result.Stall = stallOutOfTickets
+		status = fmt.Sprintf("Dispensing stopped after %d/%d tickets.\nNo ticket reached the sensor, the machine may be out of tickets.", result.Dispensed, n)
+	default:
+		result.Outcome, err = jobJammed, errJammed
+		result.Stall = stallMidRun
+		status = fmt.Sprintf("Dispensing stopped after %d/%d tickets.\nThe feed jammed mid-run, check the ticket path.", result.Dispensed, n)
+	}
+
+	if result.JamRetries > 0 {
+		status += fmt.Sprintf(" (%d jam retries)", result.JamRetries)
+	}
+	if result.Splices >= config.SpliceWarnCount {
+		status += fmt.Sprintf(" Warning: %d splices detected, check the sensor threshold.", result.Splices)
+	} else if result.Splices > 0 {
+		status += fmt.Sprintf(" (%d splice passed)", result.Splices)
+	}
+	fields := []any{
+		"outcome", result.Outcome,
+		"requested", n,
+		"ticketsDispensed", result.Dispensed,
+		"jamRetries", result.JamRetries,
+		"splices", result.Splices,
+		"sensorSilence", since(lastEdge),
+		"duration", since(startTime),
+	}
+	if result.Stall != "" {
+		fields = append(fields, "stall", result.Stall)
+	}
+	d.event(level, status, fields...)
+	return result, err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// step holds the scripted sensor active, or not, for d.
+type step struct {
+	active bool
+	d      time.Duration
+}
+
+// feed scripts n tickets, each a pulse of width after gap of silence.
+func feed(n int, gap, width time.Duration) []step {
+	var steps []step
+	for range n {
+		steps = append(steps, step{false, gap}, step{true, width})
+	}
+	return steps
+}
+
+// scriptedHardware is a fake Hardware whose sensor plays script back on
+// clock from the moment the motor is first switched on, and stays inactive
+// once the script runs out. It records every motor and pin call in order.
+type scriptedHardware struct {
+	script []step
+
+	mu      sync.Mutex
+	started time.Time
+	calls   []string
+}
+
+func (h *scriptedHardware) record(call string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, call)
+}
+
+func (h *scriptedHardware) SetHigh() {
+	h.mu.Lock()
+	if h.started.IsZero() {
+		h.started = clock.Now()
+	}
+	h.mu.Unlock()
+	h.record("high")
+}
+
+func (h *scriptedHardware) SetLow() {
+	h.record("low")
+}
+
+func (h *scriptedHardware) ReadSensor() rpio.State {
+	h.mu.Lock()
+	started := h.started
+	h.mu.Unlock()
+
+	active := false
+	if !started.IsZero() {
+		at := since(started)
+		for _, s := range h.script {
+			if at < s.d {
+				active = s.active
+				break
+			}
+			at -= s.d
+		}
+	}
+	if active != (config.SensorActive == "low") {
+		return rpio.High
+	}
+	return rpio.Low
+}
+
+func (h *scriptedHardware) SafeState() []PinReport {
+	h.record("safe")
+	return nil
+}
+
+func (h *scriptedHardware) Pins() []PinReport {
+	return nil
+}
+
+// lastCall is the most recent motor or pin call.
+func (h *scriptedHardware) lastCall() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.calls) == 0 {
+		return ""
+	}
+	return h.calls[len(h.calls)-1]
+}
+
+func TestDispense(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        []step
+		requested     int
+		ticketTimeout time.Duration
+		mainTimeout   time.Duration
+		// cancelAfter, if set, cancels the run that long after it starts.
+		cancelAfter time.Duration
+
+		wantDispensed int
+		wantOutcome   string
+		wantErr       error
+	}{
+		{
+			name:          "success",
+			script:        feed(3, 15*time.Millisecond, 15*time.Millisecond),
+			requested:     3,
+			wantDispensed: 3,
+			wantOutcome:   jobDone,
+		},
+		{
+			name:          "jam",
+			script:        feed(2, 15*time.Millisecond, 15*time.Millisecond),
+			requested:     5,
+			wantDispensed: 2,
+			wantOutcome:   jobJammed,
+			wantErr:       errJammed,
+		},
+		{
+			name:          "timeout",
+			script:        feed(2, 15*time.Millisecond, 15*time.Millisecond),
+			requested:     5,
+			ticketTimeout: time.Second,
+			mainTimeout:   200 * time.Millisecond,
+			wantDispensed: 2,
+			wantOutcome:   jobTimeout,
+			wantErr:       errTimedOut,
+		},
+		{
+			name:          "cancel",
+			script:        feed(2, 15*time.Millisecond, 15*time.Millisecond),
+			requested:     5,
+			ticketTimeout: time.Second,
+			cancelAfter:   300 * time.Millisecond,
+			wantDispensed: 2,
+			wantOutcome:   jobCancelled,
+			wantErr:       errCancelled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			if tt.ticketTimeout > 0 {
+				config.TicketTimeout = Duration{tt.ticketTimeout}
+			}
+			if tt.mainTimeout > 0 {
+				config.MainTimeout = Duration{tt.mainTimeout}
+			}
+
+			clk := useFakeClock(t)
+			hw := &scriptedHardware{script: tt.script}
+			d := newDispenser("main", hw)
+			cancelled := false
+			result, err := clk.dispense(d, tt.requested, func(elapsed time.Duration) {
+				if tt.cancelAfter > 0 && elapsed >= tt.cancelAfter && !cancelled {
+					cancelled = true
+					d.Cancel()
+				}
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if result.Outcome != tt.wantOutcome {
+				t.Errorf("Outcome = %q, want %q", result.Outcome, tt.wantOutcome)
+			}
+			if result.Dispensed != tt.wantDispensed {
+				t.Errorf("Dispensed = %d, want %d", result.Dispensed, tt.wantDispensed)
+			}
+			if call := hw.lastCall(); call != "low" {
+				t.Errorf("last motor call = %q, want the motor left low", call)
+			}
+			if status := d.Status(); status.IsDispensing {
+				t.Error("dispenser still marked as dispensing after the run")
+			}
+		})
+	}
+}
+
+func TestDispenseResult(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        []step
+		requested     int
+		jamRetries    int
+		ticketTimeout time.Duration
+		mainTimeout   time.Duration
+
+		want Result
+	}{
+		{
+			name:      "stops at exactly the request with tickets to spare",
+			script:    feed(10, 15*time.Millisecond, 15*time.Millisecond),
+			requested: 4,
+			want:      Result{Requested: 4, Dispensed: 4, Outcome: jobDone},
+		},
+		{
+			name:       "jams after three, through a retry",
+			script:     feed(3, 15*time.Millisecond, 15*time.Millisecond),
+			requested:  6,
+			jamRetries: 1,
+			want:       Result{Requested: 6, Dispensed: 3, JamRetries: 1, Outcome: jobJammed, Stall: stallMidRun},
+		},
+		{
+			name:      "never feeds",
+			requested: 2,
+			want:      Result{Requested: 2, Outcome: jobJammed, Stall: stallOutOfTickets},
+		},
+		{
+			name:          "times out while still feeding",
+			script:        feed(100, 85*time.Millisecond, 15*time.Millisecond),
+			requested:     100,
+			ticketTimeout: time.Second,
+			mainTimeout:   250 * time.Millisecond,
+			want:          Result{Requested: 100, Dispensed: 2, Outcome: jobTimeout},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			config.JamRetries = tt.jamRetries
+			if tt.ticketTimeout > 0 {
+				config.TicketTimeout = Duration{tt.ticketTimeout}
+			}
+			if tt.mainTimeout > 0 {
+				config.MainTimeout = Duration{tt.mainTimeout}
+			}
+
+			clk := useFakeClock(t)
+			d := newDispenser("main", &scriptedHardware{script: tt.script})
+			result, _ := clk.dispense(d, tt.requested, nil)
+			if result != tt.want {
+				t.Errorf("Result = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+// runEmpty dispenses from a feeder whose sensor never moves.
+func runEmpty(clk *fakeClock, d *Dispenser) (Result, error) {
+	d.hw = &scriptedHardware{}
+	return clk.dispense(d, 2, nil)
+}
+
+func TestLikelyEmpty(t *testing.T) {
+	useTestConfig(t)
+	config.EmptyRunThreshold = 3
+	config.EmptyFirstTicketTimeout = Duration{20 * time.Millisecond}
+	config.JamRetries = 1
+	clk := useFakeClock(t)
+	d := newDispenser("main", &scriptedHardware{})
+
+	for run := 1; run < config.EmptyRunThreshold; run++ {
+		if _, err := runEmpty(clk, d); !errors.Is(err, errJammed) {
+			t.Fatalf("empty run %d: err = %v, want %v", run, err, errJammed)
+		}
+		if d.Status().LikelyEmpty {
+			t.Fatalf("latched as empty after %d of %d empty runs", run, config.EmptyRunThreshold)
+		}
+	}
+	if _, err := runEmpty(clk, d); !errors.Is(err, errEmpty) {
+		t.Fatalf("empty run %d: err = %v, want %v", config.EmptyRunThreshold, err, errEmpty)
+	}
+	if !d.Status().LikelyEmpty {
+		t.Fatalf("not latched as empty after %d empty runs", config.EmptyRunThreshold)
+	}
+
+	// Once latched, a run gives up on the first ticket without retrying
+	result, err := runEmpty(clk, d)
+	if !errors.Is(err, errEmpty) || result.JamRetries != 0 || result.Stall != stallOutOfTickets {
+		t.Errorf("latched run: Result = %+v, err = %v", result, err)
+	}
+
+	// A run that feeds clears the latch and the streak behind it
+	d.hw = &scriptedHardware{script: feed(1, 15*time.Millisecond, 15*time.Millisecond)}
+	if _, err := clk.dispense(d, 1, nil); err != nil {
+		t.Fatalf("feeding run: err = %v", err)
+	}
+	if d.Status().LikelyEmpty {
+		t.Error("still latched as empty after a run that fed")
+	}
+	if _, err := runEmpty(clk, d); !errors.Is(err, errJammed) {
+		t.Errorf("first empty run after feeding: err = %v, want %v", err, errJammed)
+	}
+	if d.Status().LikelyEmpty {
+		t.Error("latched as empty again after a single empty run")
+	}
+}
+
+func TestLikelyEmptyClearsOnRefill(t *testing.T) {
+	useTestConfig(t)
+	config.EmptyRunThreshold = 2
+	clk := useFakeClock(t)
+	srv, routes := newTestRoutes(t)
+	d := srv.dispensers[0]
+
+	runEmpty(clk, d)
+	runEmpty(clk, d)
+	if !d.Status().LikelyEmpty {
+		t.Fatal("not latched as empty")
+	}
+
+	w := serve(routes, http.MethodPost, "/api/inventory", "application/json", `{"count": 500}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refill status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	status := d.Status()
+	if status.LikelyEmpty {
+		t.Error("still latched as empty after a refill")
+	}
+	if status.Remaining == nil || *status.Remaining != 500 {
+		t.Errorf("ticketsRemaining = %v, want 500", status.Remaining)
+	}
+
+	// The streak starts over too, so a single empty run doesn't latch it
+	if _, err := runEmpty(clk, d); !errors.Is(err, errJammed) {
+		t.Errorf("empty run after refill: err = %v, want %v", err, errJammed)
+	}
+	if d.Status().LikelyEmpty {
+		t.Error("latched as empty again after a single empty run")
+	}
+}
+
+func TestDispenseSplice(t *testing.T) {
+	gap, ticket := 15*time.Millisecond, 15*time.Millisecond
+	splicePulse := 150 * time.Millisecond
+	splice := []step{{false, gap}, {true, splicePulse + 50*time.Millisecond}}
+
+	tests := []struct {
+		name      string
+		script    []step
+		requested int
+		want      Result
+	}{
+		{
+			name:      "clean splice",
+			script:    append(append(feed(2, gap, ticket), splice...), feed(2, gap, ticket)...),
+			requested: 4,
+			want:      Result{Requested: 4, Dispensed: 4, Splices: 1, Outcome: jobDone},
+		},
+		{
+			name:      "splice then jam",
+			script:    append(feed(1, gap, ticket), splice...),
+			requested: 3,
+			want:      Result{Requested: 3, Dispensed: 1, Splices: 1, Outcome: jobJammed, Stall: stallMidRun},
+		},
+		{
+			name:      "two splices",
+			script:    append(append(append(feed(1, gap, ticket), splice...), splice...), feed(1, gap, ticket)...),
+			requested: 2,
+			want:      Result{Requested: 2, Dispensed: 2, Splices: 2, Outcome: jobDone},
+		},
+		{
+			// A slow ticket holds the sensor well past a normal pulse but
+			// short of a join, and still counts
+			name:      "long pulse is a ticket",
+			script:    feed(2, gap, splicePulse/2),
+			requested: 2,
+			want:      Result{Requested: 2, Dispensed: 2, Outcome: jobDone},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			config.SplicePulse = Duration{splicePulse}
+			// Long enough for a join to pass without counting as a jam, and
+			// doubled for the tickets after one
+			config.TicketTimeout = Duration{2 * splicePulse}
+
+			clk := useFakeClock(t)
+			d := newDispenser("main", &scriptedHardware{script: tt.script})
+			result, _ := clk.dispense(d, tt.requested, nil)
+			if result != tt.want {
+				t.Errorf("Result = %+v, want %+v", result, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpliceRecorded(t *testing.T) {
+	useTestConfig(t)
+	splicePulse := 150 * time.Millisecond
+	config.SplicePulse = Duration{splicePulse}
+	config.TicketTimeout = Duration{2 * splicePulse}
+	clk := useFakeClock(t)
+
+	gap, ticket := 15*time.Millisecond, 15*time.Millisecond
+	script := append(feed(1, gap, ticket), step{false, gap}, step{true, splicePulse + 50*time.Millisecond})
+	d := newDispenser("main", &scriptedHardware{script: append(script, feed(1, gap, ticket)...)})
+
+	mutex.Lock()
+	job := addJob(d.Name, 2)
+	d.current = job
+	mutex.Unlock()
+	clk.run(func() { d.runJob(job) }, nil)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if job.State != jobDone || job.Dispensed != 2 || job.Splices != 1 {
+		t.Errorf("job = %+v, want done with 2 tickets and 1 splice", job)
+	}
+	if entry := historyEntryFor(job); entry.Splices != 1 {
+		t.Errorf("history entry = %+v, want 1 splice", entry)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// machine is the whole server on simulated hardware, wired up the way main
+// does it and served over httptest. Its feeder runs on a fake clock that
+// only moves when the test moves it, so a test can stop the machine at any
+// point of a run and look at it.
+type machine struct {
+	t      *testing.T
+	server *httptest.Server
+	d      *Dispenser
+	clock  *fakeClock
+}
+
+// startMachine boots a single-dispenser machine on the current config. Its
+// simulated feeder jams for good after jamAfter tickets, unless that is 0.
+// The machine gets a shutdown of its own, which the cleanup goes through
+// like a real stop, so nothing it started outlives the test.
+func startMachine(t *testing.T, jamAfter int) *machine {
+	t.Helper()
+
+	savedCtx, savedStop, savedShutdown := shutdownCtx, stopAll, shutdown
+	shutdownCtx, stopAll = context.WithCancelCause(context.Background())
+	shutdown = shutdownCtx.Done()
+
+	clk := useFakeClock(t)
+	d := newDispenser("main", newSimulatedHardware(config.SimInterval.Duration, jamAfter, false))
+	enterSafeState("startup", d)
+	static, err := newStaticHandler(config.StaticDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer([]*Dispenser{d})
+	go d.run()
+	server := httptest.NewServer(withRequestLog(withCORS(srv.routes(static))))
+
+	t.Cleanup(func() {
+		server.Close()
+		mutex.Lock()
+		stopAll(errShuttingDown)
+		mutex.Unlock()
+
+		// A run cut short is still waiting on the clock, and only stops
+		// once it wakes up and sees the shutdown
+		for stopped := false; !stopped; {
+			select {
+			case <-d.done:
+				stopped = true
+			case <-time.After(time.Millisecond):
+				clk.next()
+			}
+		}
+		shutdownCtx, stopAll, shutdown = savedCtx, savedStop, savedShutdown
+	})
+	return &machine{t: t, server: server, d: d, clock: clk}
+}
+
+// settle waits until the machine has done everything it can without the
+// clock moving: the worker is either waiting on the clock or has nothing
+// left to run. It reports whether the worker is waiting on the clock.
+func (m *machine) settle() bool {
+	m.t.Helper()
+	// Only there so a broken test fails instead of hanging
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if m.clock.waiting() > 0 {
+			return true
+		}
+
+		mutex.Lock()
+		idle := len(m.d.queue) == 0 && !m.d.dispensing && (m.d.current == nil || m.d.current.FinishedAt != nil)
+		mutex.Unlock()
+		if idle {
+			return false
+		}
+
+		if time.Now().After(deadline) {
+			m.t.Fatal("machine never settled")
+		}
+		select {
+		case <-m.clock.added:
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// do sends a request with a JSON body, if there is one, and returns the
+// status code and decoded response.
+func (m *machine) do(method, path, body string) (int, map[string]any) {
+	m.t.Helper()
+	r, err := http.NewRequest(method, m.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.server.Client().Do(r)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var decoded map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		m.t.Fatalf("%s %s: response is not JSON: %v", method, path, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+// dispense queues tickets and returns the job ID and queue position.
+func (m *machine) dispense(tickets string) (string, int) {
+	m.t.Helper()
+	code, body := m.do(http.MethodPost, "/api/dispense", `{"tickets": `+tickets+`}`)
+	if code != http.StatusAccepted {
+		m.t.Fatalf("dispense %s: status = %d, want %d: %v", tickets, code, http.StatusAccepted, body)
+	}
+	id, _ := body["jobId"].(string)
+	position, _ := body["position"].(float64)
+	return id, int(position)
+}
+
+func (m *machine) status() map[string]any {
+	m.t.Helper()
+	code, body := m.do(http.MethodGet, "/api/status", "")
+	if code != http.StatusOK {
+		m.t.Fatalf("status: %d", code)
+	}
+	return body
+}
+
+// until moves the clock on, one thing the machine waits for at a time,
+// until ok holds for the status.
+func (m *machine) until(what string, ok func(status map[string]any) bool) map[string]any {
+	m.t.Helper()
+	for {
+		waiting := m.settle()
+		status := m.status()
+		if ok(status) {
+			return status
+		}
+		if !waiting {
+			m.t.Fatalf("machine went idle before %s, status %v", what, status)
+		}
+		m.clock.next()
+	}
+}
+
+// wait moves the clock on until a job finishes and returns it.
+func (m *machine) wait(id string) map[string]any {
+	m.t.Helper()
+	for {
+		waiting := m.settle()
+		code, job := m.do(http.MethodGet, "/api/jobs/"+id, "")
+		if code != http.StatusOK {
+			m.t.Fatalf("job %s: status %d", id, code)
+		}
+		if job["finishedAt"] != nil {
+			return job
+		}
+		if !waiting {
+			m.t.Fatalf("machine went idle before job %s finished: %v", id, job)
+		}
+		m.clock.next()
+	}
+}
+
+// useSimulatedConfig is useTestConfig with a fast simulated feeder: a
+// ticket every 30ms on the clock, with the sensor active for the last 15ms
+// of each.
+func useSimulatedConfig(t *testing.T) {
+	useTestConfig(t)
+	config.Simulate = true
+	config.SimInterval = Duration{30 * time.Millisecond}
+}
+
+func TestEndToEndDispense(t *testing.T) {
+	useSimulatedConfig(t)
+	m := startMachine(t, 0)
+
+	if code, _ := m.do(http.MethodPost, "/api/inventory", `{"count": 10}`); code != http.StatusOK {
+		t.Fatalf("refill status = %d", code)
+	}
+
+	id, position := m.dispense("3")
+	if position != 1 {
+		t.Errorf("position = %d, want 1", position)
+	}
+
+	job := m.wait(id)
+	if job["state"] != jobDone || job["dispensed"] != 3.0 || job["requested"] != 3.0 {
+		t.Errorf("job = %v", job)
+	}
+
+	status := m.until("the worker to finish", func(s map[string]any) bool { return s["isDispensing"] == false })
+	want := map[string]any{
+		"status":           "Successfully dispensed 3 ticket(s)",
+		"jobId":            id,
+		"requested":        3.0,
+		"dispensed":        3.0,
+		"outcome":          jobDone,
+		"queued":           0.0,
+		"ticketsPending":   0.0,
+		"ticketsRemaining": 7.0,
+		"fault":            false,
+	}
+	for field, value := range want {
+		if status[field] != value {
+			t.Errorf("status %s = %v, want %v", field, status[field], value)
+		}
+	}
+}
+
+func TestEndToEndQueue(t *testing.T) {
+	useSimulatedConfig(t)
+	config.MaxQueue = 2
+	m := startMachine(t, 0)
+
+	first, _ := m.dispense("4")
+	m.until("the first job to start", func(s map[string]any) bool { return s["isDispensing"] == true })
+
+	// A dispenser that is busy queues behind the running job
+	second, position := m.dispense("2")
+	if position != 1 {
+		t.Errorf("second job position = %d, want 1", position)
+	}
+	third, position := m.dispense("1")
+	if position != 2 {
+		t.Errorf("third job position = %d, want 2", position)
+	}
+	if code, body := m.do(http.MethodPost, "/api/dispense", `{"tickets": 1}`); code != http.StatusTooManyRequests {
+		t.Errorf("over a full queue: status = %d, want %d: %v", code, http.StatusTooManyRequests, body)
+	}
+
+	// The running job can't be taken off the queue, and nothing else can
+	// use the dispenser while it runs
+	if code, _ := m.do(http.MethodDelete, "/api/jobs/"+first, ""); code != http.StatusConflict {
+		t.Errorf("deleting the running job: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code, _ := m.do(http.MethodPost, "/api/selftest", ""); code != http.StatusConflict {
+		t.Errorf("self-test while busy: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	// The last job is dropped, the second runs once the first is done
+	if code, _ := m.do(http.MethodDelete, "/api/jobs/"+third, ""); code != http.StatusOK {
+		t.Errorf("deleting a queued job: status = %d, want %d", code, http.StatusOK)
+	}
+	firstJob, secondJob, thirdJob := m.wait(first), m.wait(second), m.wait(third)
+	if firstJob["state"] != jobDone || secondJob["state"] != jobDone || thirdJob["state"] != jobCancelled {
+		t.Errorf("states = %v, %v, %v, want done, done, cancelled", firstJob["state"], secondJob["state"], thirdJob["state"])
+	}
+	if thirdJob["startedAt"] != nil {
+		t.Error("the deleted job was started")
+	}
+	firstDone, _ := time.Parse(time.RFC3339Nano, firstJob["finishedAt"].(string))
+	secondStart, _ := time.Parse(time.RFC3339Nano, secondJob["startedAt"].(string))
+	if secondStart.Before(firstDone) {
+		t.Errorf("second job started at %v, before the first finished at %v", secondStart, firstDone)
+	}
+}
+
+func TestEndToEndTicketTimeout(t *testing.T) {
+	useSimulatedConfig(t)
+	m := startMachine(t, 2)
+
+	id, _ := m.dispense("5")
+	job := m.wait(id)
+	if job["state"] != jobJammed || job["dispensed"] != 2.0 || job["stall"] != stallMidRun {
+		t.Errorf("job = %v, want jammed mid-run after 2", job)
+	}
+
+	status := m.until("the worker to finish", func(s map[string]any) bool { return s["isDispensing"] == false })
+	if status["outcome"] != jobJammed || status["dispensed"] != 2.0 || status["stall"] != stallMidRun {
+		t.Errorf("status = %v", status)
+	}
+	if message, _ := status["status"].(string); !strings.HasPrefix(message, "Dispensing stopped after 2/5 tickets.") {
+		t.Errorf("status line = %q", message)
+	}
+}
+
+func TestEndToEndMainTimeout(t *testing.T) {
+	useSimulatedConfig(t)
+	config.MainTimeout = Duration{300 * time.Millisecond}
+	m := startMachine(t, 0)
+
+	// The tenth ticket would clear the sensor right as the timeout passes
+	id, _ := m.dispense("50")
+	job := m.wait(id)
+	if job["state"] != jobTimeout || job["dispensed"] != 9.0 {
+		t.Errorf("job = %v, want timed out after 9", job)
+	}
+
+	status := m.until("the worker to finish", func(s map[string]any) bool { return s["isDispensing"] == false })
+	if status["outcome"] != jobTimeout || status["dispensed"] != 9.0 {
+		t.Errorf("status = %v", status)
+	}
+	if message, _ := status["status"].(string); !strings.HasSuffix(message, "Operation timed out") {
+		t.Errorf("status line = %q", message)
+	}
+}
+
+func TestEndToEndStatusConsistency(t *testing.T) {
+	useSimulatedConfig(t)
+	m := startMachine(t, 0)
+
+	id, _ := m.dispense("8")
+	m.until("the job to start", func(s map[string]any) bool { return s["isDispensing"] == true })
+
+	// Every step of the run, the status agrees with itself and with the job
+	last := 0.0
+	for {
+		waiting := m.settle()
+		status := m.status()
+		if status["isDispensing"] != true {
+			break
+		}
+
+		// Fields that are zero are left out
+		dispensed, _ := status["dispensed"].(float64)
+		pending, _ := status["ticketsPending"].(float64)
+		if status["jobId"] != id || status["requested"] != 8.0 {
+			t.Fatalf("running status is for another job: %v", status)
+		}
+		if dispensed < last || dispensed > 8 {
+			t.Fatalf("dispensed went from %v to %v", last, dispensed)
+		}
+		if pending != 8-dispensed {
+			t.Fatalf("ticketsPending = %v with %v of 8 dispensed", pending, dispensed)
+		}
+		dispensers, _ := status["dispensers"].([]any)
+		if len(dispensers) != 1 {
+			t.Fatalf("dispensers = %v, want one", status["dispensers"])
+		}
+		if first, _ := dispensers[0].(map[string]any)["dispensed"].(float64); first != dispensed {
+			t.Fatalf("dispensers[0] dispensed %v, top level %v", first, dispensed)
+		}
+		last = dispensed
+
+		if !waiting {
+			t.Fatalf("worker idle while the status says it is dispensing: %v", status)
+		}
+		m.clock.next()
+	}
+
+	job := m.wait(id)
+	status := m.status()
+	if job["dispensed"] != 8.0 || status["dispensed"] != 8.0 || status["outcome"] != jobDone || status["ticketsPending"] != 0.0 {
+		t.Errorf("after the run: job %v, status %v", job, status)
+	}
+}
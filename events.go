@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// broadcaster pushes the status JSON to every connected /api/events client
+// whenever it changes. Anything that changes machine state calls
+// statusChanged; the broadcaster snapshots the status itself, so callers
+// never block on slow clients.
+type broadcaster struct {
+	changed chan struct{}
+
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	last    []byte
+}
+
+var events = &broadcaster{
+	changed: make(chan struct{}, 1),
+	clients: map[chan []byte]struct{}{},
+}
+
+// statusChanged tells the broadcaster to publish a fresh status. It never
+// blocks and is safe to call with mutex held.
+func statusChanged() {
+	select {
+	case events.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes a fresh snapshot, taken with mutex held, whenever
+// statusChanged is called.
+func (b *broadcaster) run(snapshot func() StatusResponse) {
+	for range b.changed {
+		mutex.Lock()
+		response := snapshot()
+		mutex.Unlock()
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			continue
+		}
+
+		b.mu.Lock()
+		if bytes.Equal(data, b.last) {
+			b.mu.Unlock()
+			continue
+		}
+		b.last = data
+		for client := range b.clients {
+			send(client, data)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// send hands data to a client, replacing anything it hasn't read yet since
+// only the newest status matters.
+func send(client chan []byte, data []byte) {
+	select {
+	case <-client:
+	default:
+	}
+	client <- data
+}
+
+func (b *broadcaster) subscribe() chan []byte {
+	client := make(chan []byte, 1)
+
+	b.mu.Lock()
+	b.clients[client] = struct{}{}
+	if b.last != nil {
+		client <- b.last
+	}
+	b.mu.Unlock()
+
+	return client
+}
+
+func (b *broadcaster) unsubscribe(client chan []byte) {
+	b.mu.Lock()
+	delete(b.clients, client)
+	b.mu.Unlock()
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	client := events.subscribe()
+	defer events.unsubscribe(client)
+
+	// Make sure a brand new client gets a status even if nothing has been
+	// published since startup.
+	statusChanged()
+
+	// Comments keep idle connections alive through proxies and let a dead
+	// client surface as a write error.
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shutdown:
+			return
+		case data := <-client:
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
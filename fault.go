@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idleFeedFault is the status line of a dispenser that fed tickets with no
+// run going, which almost always means its relay stuck closed.
+const idleFeedFault = "FAULT: tickets feeding while idle — check relay"
+
+const (
+	// idlePollInterval is how often the sensor is sampled between runs.
+	idlePollInterval = 10 * time.Millisecond
+	// idleSettle is how long after a run the idle watch waits before it
+	// counts tickets, so a roll coasting to a stop isn't taken for a fault.
+	idleSettle = time.Second
+)
+
+// Fault is set when the machine has done something it was never told to,
+// such as feeding tickets between dispenses. Dispensing is refused until it
+// is cleared with POST /api/fault/clear, including after a restart.
+type Fault struct {
+	Active    bool       `json:"active"`
+	Reason    string     `json:"reason,omitempty"`
+	Dispenser string     `json:"dispenser,omitempty"`
+	Tickets   int        `json:"tickets,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+}
+
+var (
+	// fault is guarded by mutex.
+	fault Fault
+
+	// faultSaveMu orders saves so an older snapshot can never overwrite a
+	// newer one and bring back a fault that was cleared, or lose one that
+	// was just latched.
+	faultSaveMu sync.Mutex
+)
+
+func loadFault(path string) error {
+	if err := readJSONFile(path, &fault); err != nil {
+		return fmt.Errorf("reading fault state: %w", err)
+	}
+	if fault.Active {
+		slog.Error("Starting with a fault, dispensing is blocked until it is cleared", "reason", fault.Reason, "dispenser", fault.Dispenser)
+	}
+	return nil
+}
+
+// saveFault writes the fault state to disk. It must be called without
+// mutex held.
+func saveFault() {
+	faultSaveMu.Lock()
+	defer faultSaveMu.Unlock()
+
+	mutex.Lock()
+	snapshot := fault
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.FaultFile, snapshot); err != nil {
+		slog.Error("Error saving fault state", "err", err)
+	}
+}
+
+// watchIdle samples d's sensor whenever it has no run going, until
+// shutdown. Once config.IdleFeedTickets pass within config.IdleFeedWindow,
+// the motor is driven low again and the machine faults. If tickets keep
+// coming while it is faulted, every further batch drives the motor low
+// again, in case the relay only sticks now and then.
+func (s *Server) watchIdle(d *Dispenser) {
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	var sensor *sensorWatcher
+	var busyUntil time.Time
+	var pulseStart time.Time
+	var recent []time.Time
+
+	for {
+		var now time.Time
+		select {
+		case <-shutdown:
+			return
+		case now = <-ticker.C:
+		}
+
+		mutex.Lock()
+		busy := d.dispensing
+		mutex.Unlock()
+		if busy {
+			busyUntil = now
+			sensor = nil
+			continue
+		}
+		if now.Sub(busyUntil) < idleSettle {
+			continue
+		}
+		if sensor == nil {
+			sensor = newPollingSensorWatcher(d.hw)
+			pulseStart = time.Time{}
+			recent = nil
+		}
+
+		// Tickets are counted on the trailing edge, as in a run
+		for _, active := range sensor.poll() {
+			if active {
+				pulseStart = now
+				continue
+			}
+			if pulseStart.IsZero() {
+				continue
+			}
+			pulseStart = time.Time{}
+			recent = append(recent, now)
+		}
+
+		cutoff := now.Add(-config.IdleFeedWindow.Duration)
+		for len(recent) > 0 && recent[0].Before(cutoff) {
+			recent = recent[1:]
+		}
+		if len(recent) >= config.IdleFeedTickets {
+			s.idleFeed(d, len(recent))
+			recent = nil
+		}
+	}
+}
+
+// idleFeed stops a motor found feeding tickets with no run going and puts
+// the machine into a fault, or adds to the one it is already in. It must
+// be called without mutex held.
+func (s *Server) idleFeed(d *Dispenser, tickets int) {
+	mutex.Lock()
+	// Holding mutex while the motor is driven low keeps a run that has
+	// just started from having its motor stopped under it
+	if d.dispensing {
+		mutex.Unlock()
+		return
+	}
+	d.hw.SetLow()
+	for range tickets {
+		d.takeTicket()
+	}
+	if fault.Active {
+		if fault.Dispenser == d.Name {
+			fault.Tickets += tickets
+		}
+		mutex.Unlock()
+		slog.Warn("Tickets still feeding while faulted, motor driven low again", "dispenser", d.Name, "tickets", tickets)
+		saveFault()
+		saveInventory()
+		return
+	}
+
+	now := time.Now()
+	fault = Fault{
+		Active:    true,
+		Reason:    idleFeedFault,
+		Dispenser: d.Name,
+		Tickets:   tickets,
+		Since:     &now,
+	}
+	// Queued jobs would start straight into a feeder nobody controls, so
+	// they go; other dispensers' runs are left to finish
+	for _, other := range s.dispensers {
+		other.dropQueued()
+	}
+	d.event(slog.LevelError, idleFeedFault, "tickets", tickets, "window", config.IdleFeedWindow.Duration)
+	mutex.Unlock()
+
+	saveFault()
+	saveInventory()
+	notifyWebhooks(WebhookEvent{
+		Event:     eventFault,
+		Dispenser: d.Name,
+		Dispensed: tickets,
+		Reason:    idleFeedFault,
+	})
+}
+
+// faultClearHandler lifts the fault once someone has checked the machine.
+// If the relay is still stuck the idle watch trips it again.
+func (s *Server) faultClearHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	if !fault.Active {
+		mutex.Unlock()
+		writeError(w, http.StatusConflict, "There is no fault to clear")
+		return
+	}
+	cleared := fault
+	fault = Fault{}
+	if d := s.find(cleared.Dispenser); d != nil && !d.dispensing {
+		d.status = "Fault cleared"
+	}
+	statusChanged()
+	mutex.Unlock()
+
+	saveFault()
+	slog.Warn("Fault cleared", "reason", cleared.Reason, "dispenser", cleared.Dispenser, "tickets", cleared.Tickets, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Fault cleared",
+	})
+}
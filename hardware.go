@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// Hardware is everything the dispenser needs from the machine: a motor relay
+// it can switch and an optical sensor it can read. The real implementation
+// drives GPIO through rpio; simulation mode swaps in a fake.
+type Hardware interface {
+	// SetHigh energizes the dispenser motor.
+	SetHigh()
+	// SetLow de-energizes the dispenser motor.
+	SetLow()
+	// ReadSensor returns the current level of the ticket sensor.
+	ReadSensor() rpio.State
+	// SafeState puts every pin into its inactive state, motor first, and
+	// reports what each pin reads back afterwards.
+	SafeState() []PinReport
+	// Pins reports the current level of every pin without changing them.
+	Pins() []PinReport
+}
+
+// gpioPin is the part of rpio.Pin the hardware drives.
+type gpioPin interface {
+	Input()
+	Output()
+	Pwm()
+	High()
+	Low()
+	Freq(freq int)
+	DutyCycle(dutyLen, cycleLen uint32)
+	Read() rpio.State
+	PullUp()
+	PullDown()
+	Detect(edge rpio.Edge)
+	EdgeDetected() bool
+}
+
+// openPin returns the GPIO pin with a BCM number. Tests swap it for fakes
+// that record what is done to each pin.
+var openPin = func(pin int) gpioPin {
+	return rpio.Pin(pin)
+}
+
+// gpioHardware drives a dispenser wired to the Pi's GPIO header. rpio.Open
+// must have been called before it is used.
+type gpioHardware struct {
+	motorPin, sensorPin int
+	buttonPins          []int
+
+	motor   gpioPin
+	sensor  gpioPin
+	buttons []gpioPin
+
+	// pwm is set while the motor pin is switched to hardware PWM by
+	// SetDuty. mu guards it, since a cancel stops the motor from another
+	// goroutine than the one ramping it.
+	mu  sync.Mutex
+	pwm bool
+}
+
+func newGPIOHardware(motorPin, sensorPin int, buttonPins []int) *gpioHardware {
+	g := &gpioHardware{
+		motorPin:   motorPin,
+		sensorPin:  sensorPin,
+		buttonPins: buttonPins,
+		motor:      openPin(motorPin),
+		sensor:     openPin(sensorPin),
+	}
+	for _, pin := range buttonPins {
+		g.buttons = append(g.buttons, openPin(pin))
+	}
+	return g
+}
+
+func (g *gpioHardware) SetHigh() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pwm {
+		g.motor.DutyCycle(pwmCycle, pwmCycle)
+		return
+	}
+	g.motor.High()
+}
+
+// SetLow hands a motor pin running PWM back to plain output before driving
+// it low, so the pin is left in the same state however the motor ran.
+func (g *gpioHardware) SetLow() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pwm {
+		g.motor.DutyCycle(0, pwmCycle)
+		g.motor.Output()
+		g.pwm = false
+	}
+	g.motor.Low()
+}
+
+func (g *gpioHardware) ReadSensor() rpio.State {
+	return g.sensor.Read()
+}
+
+// SafeState drives the motor latch low before and after switching the pin to
+// an output so a level left high by a previous process never reaches the
+// relay, then configures the sensor and button inputs. The sensor is pulled
+// towards its inactive level, so a disconnected sensor never reads as a
+// notch; the buttons are wired to ground and pulled up.
+func (g *gpioHardware) SafeState() []PinReport {
+	g.mu.Lock()
+	if g.pwm {
+		g.motor.DutyCycle(0, pwmCycle)
+		g.pwm = false
+	}
+	g.motor.Low()
+	g.motor.Output()
+	g.motor.Low()
+	g.mu.Unlock()
+
+	g.sensor.Input()
+	if sensorPull() == "down" {
+		g.sensor.PullDown()
+	} else {
+		g.sensor.PullUp()
+	}
+
+	for _, b := range g.buttons {
+		b.Input()
+		b.PullUp()
+	}
+
+	return g.Pins()
+}
+
+func (g *gpioHardware) Pins() []PinReport {
+	pins := []PinReport{
+		{Name: "dispenser", Pin: g.motorPin, Mode: g.motorMode(), Level: levelName(g.motor.Read())},
+		{Name: "sensor", Pin: g.sensorPin, Mode: "input", Pull: sensorPull(), Level: levelName(g.sensor.Read())},
+	}
+	for i, b := range g.buttons {
+		pins = append(pins, PinReport{Name: "button", Pin: g.buttonPins[i], Mode: "input", Pull: "up", Level: levelName(b.Read())})
+	}
+	return pins
+}
+
+// sensorPull is config.SensorPull if set, otherwise "down" for an active-high
+// sensor and "up" for an active-low one.
+func sensorPull() string {
+	if config.SensorPull != "" {
+		return config.SensorPull
+	}
+	if config.SensorActive == "low" {
+		return "up"
+	}
+	return "down"
+}
+
+func (g *gpioHardware) motorMode() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pwm {
+		return "pwm"
+	}
+	return "output"
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// pinLog records every call made to the fake pins, in order, as
+// "<pin> <method>".
+type pinLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *pinLog) take() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := l.calls
+	l.calls = nil
+	return calls
+}
+
+// fakePin stands in for an rpio.Pin and always reads low.
+type fakePin struct {
+	number int
+	log    *pinLog
+}
+
+func (p fakePin) record(method string, args ...any) {
+	call := fmt.Sprintf("%d %s", p.number, method)
+	if len(args) > 0 {
+		call += fmt.Sprint(args...)
+	}
+	p.log.mu.Lock()
+	defer p.log.mu.Unlock()
+	p.log.calls = append(p.log.calls, call)
+}
+
+func (p fakePin) Input()                             { p.record("Input") }
+func (p fakePin) Output()                            { p.record("Output") }
+func (p fakePin) Pwm()                               { p.record("Pwm") }
+func (p fakePin) High()                              { p.record("High") }
+func (p fakePin) Low()                               { p.record("Low") }
+func (p fakePin) Freq(freq int)                      { p.record("Freq") }
+func (p fakePin) DutyCycle(dutyLen, cycleLen uint32) { p.record("DutyCycle", dutyLen) }
+func (p fakePin) Read() rpio.State                   { return rpio.Low }
+func (p fakePin) PullUp()                            { p.record("PullUp") }
+func (p fakePin) PullDown()                          { p.record("PullDown") }
+func (p fakePin) Detect(edge rpio.Edge)              { p.record("Detect") }
+func (p fakePin) EdgeDetected() bool                 { return false }
+
+// useFakePins makes openPin hand out fake pins that record into the
+// returned log.
+func useFakePins(t *testing.T) *pinLog {
+	t.Helper()
+	log := &pinLog{}
+	real := openPin
+	openPin = func(pin int) gpioPin { return fakePin{pin, log} }
+	t.Cleanup(func() { openPin = real })
+	return log
+}
+
+func TestGPIOSafeState(t *testing.T) {
+	tests := []struct {
+		name         string
+		sensorActive string
+		sensorPull   string
+		// pwm runs the motor at part speed before the safe state.
+		pwm bool
+
+		wantMotor []string
+		wantPull  string
+	}{
+		{"active high", "high", "", false, []string{"18 Low", "18 Output", "18 Low"}, "down"},
+		{"active low", "low", "", false, []string{"18 Low", "18 Output", "18 Low"}, "up"},
+		{"active high pulled up", "high", "up", false, []string{"18 Low", "18 Output", "18 Low"}, "up"},
+		{"running on pwm", "high", "", true, []string{"18 DutyCycle0", "18 Low", "18 Output", "18 Low"}, "down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			config.SensorActive = tt.sensorActive
+			config.SensorPull = tt.sensorPull
+			log := useFakePins(t)
+
+			g := newGPIOHardware(18, 17, []int{22, 23})
+			if tt.pwm {
+				g.SetDuty(0.5)
+			}
+			log.take()
+
+			reports := g.SafeState()
+			calls := log.take()
+
+			// The motor is stopped before any other pin is touched
+			motor := len(tt.wantMotor)
+			if len(calls) < motor || !slices.Equal(calls[:motor], tt.wantMotor) {
+				t.Fatalf("calls = %v, want them to start with %v", calls, tt.wantMotor)
+			}
+			for _, call := range calls[motor:] {
+				if strings.HasPrefix(call, "18 ") {
+					t.Errorf("motor pin touched after the inputs: %v", calls)
+				}
+			}
+
+			pull := "PullUp"
+			if tt.wantPull == "down" {
+				pull = "PullDown"
+			}
+			want := []string{"17 Input", "17 " + pull, "22 Input", "22 PullUp", "23 Input", "23 PullUp"}
+			if !slices.Equal(calls[motor:], want) {
+				t.Errorf("input calls = %v, want %v", calls[motor:], want)
+			}
+
+			if len(reports) != 4 {
+				t.Fatalf("got %d pin reports, want 4", len(reports))
+			}
+			if r := reports[0]; r.Name != "dispenser" || r.Pin != 18 || r.Mode != "output" || r.Level != "low" {
+				t.Errorf("motor report = %+v", r)
+			}
+			if r := reports[1]; r.Name != "sensor" || r.Pin != 17 || r.Pull != tt.wantPull {
+				t.Errorf("sensor report = %+v, want pull %q", r, tt.wantPull)
+			}
+			if r := reports[3]; r.Name != "button" || r.Pin != 23 || r.Pull != "up" {
+				t.Errorf("button report = %+v", r)
+			}
+		})
+	}
+}
+
+func TestEnterSafeState(t *testing.T) {
+	useTestConfig(t)
+	log := useFakePins(t)
+	front := newDispenser("front", newGPIOHardware(18, 17, nil))
+	back := newDispenser("back", newGPIOHardware(13, 27, nil))
+
+	report := enterSafeState("test", front, back)
+	want := []string{
+		"18 Low", "18 Output", "18 Low", "17 Input", "17 PullDown",
+		"13 Low", "13 Output", "13 Low", "27 Input", "27 PullDown",
+	}
+	if calls := log.take(); !slices.Equal(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if len(report.Pins) != 4 || report.Pins[0].Dispenser != "front" || report.Pins[2].Dispenser != "back" {
+		t.Errorf("report pins = %+v", report.Pins)
+	}
+}
+
+// The defaults differ from the first releases, which always pulled the
+// sensor up and counted a ticket as its level rose. This pins what a config
+// that says nothing about the sensor now gets: pulled down, a notch reading
+// High, and the ticket counted once the level falls again.
+func TestDefaultSensorWiring(t *testing.T) {
+	useTestConfig(t)
+	defaults := defaultConfig()
+	if defaults.SensorActive != "high" || defaults.SensorPull != "" {
+		t.Fatalf("sensorActive = %q, sensorPull = %q, want \"high\" and empty", defaults.SensorActive, defaults.SensorPull)
+	}
+
+	log := useFakePins(t)
+	newGPIOHardware(18, 17, nil).SafeState()
+	if calls := log.take(); !slices.Contains(calls, "17 PullDown") || slices.Contains(calls, "17 PullUp") {
+		t.Errorf("calls = %v, want the sensor pulled down", calls)
+	}
+
+	clk := useFakeClock(t)
+	hw := &scriptedHardware{script: feed(1, 15*time.Millisecond, 15*time.Millisecond)}
+	d := newDispenser("main", hw)
+	mutex.Lock()
+	job := addJob(d.Name, 1)
+	d.current = job
+	mutex.Unlock()
+
+	sawHigh := false
+	clk.run(func() { d.runJob(job) }, func(time.Duration) {
+		if hw.ReadSensor() != rpio.High {
+			return
+		}
+		sawHigh = true
+		mutex.Lock()
+		defer mutex.Unlock()
+		if job.Dispensed != 0 {
+			t.Errorf("ticket counted while the sensor still read High")
+		}
+	})
+
+	if !sawHigh {
+		t.Error("the notch never read High")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if job.Dispensed != 1 {
+		t.Errorf("Dispensed = %d, want the ticket counted once the sensor fell", job.Dispensed)
+	}
+}
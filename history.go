@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one line of the history file: the outcome of a single
+// dispense attempt.
+type HistoryEntry struct {
+	Time  time.Time `json:"time"`
+	JobID string    `json:"jobId,omitempty"`
+	// Kind is empty for dispenses and historySelfTest for self-tests.
+	Kind       string `json:"kind,omitempty"`
+	Dispenser  string `json:"dispenser,omitempty"`
+	Requested  int    `json:"requested"`
+	Dispensed  int    `json:"dispensed"`
+	JamRetries int    `json:"jamRetries,omitempty"`
+	Splices    int    `json:"splices,omitempty"`
+	Outcome    string `json:"outcome"`
+	Stall      string `json:"stall,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type DaySummary struct {
+	Date       string `json:"date"`
+	Operations int    `json:"operations"`
+	Requested  int    `json:"requested"`
+	Dispensed  int    `json:"dispensed"`
+	JamRetries int    `json:"jamRetries"`
+}
+
+// historyLog appends entries to a JSON-lines file from its own goroutine so
+// the dispense loop never waits on the disk.
+type historyLog struct {
+	path    string
+	mu      sync.Mutex
+	closed  bool
+	entries chan HistoryEntry
+	done    chan struct{}
+}
+
+var history *historyLog
+
+func openHistory(path string) (*historyLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening history file: %w", err)
+	}
+
+	h := &historyLog{
+		path:    path,
+		entries: make(chan HistoryEntry, 256),
+		done:    make(chan struct{}),
+	}
+	go h.writer(f)
+
+	return h, nil
+}
+
+func (h *historyLog) writer(f *os.File) {
+	defer close(h.done)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for entry := range h.entries {
+		if err := enc.Encode(entry); err != nil {
+			slog.Error("Error writing history", "err", err)
+		}
+
+		// Keep batching while more entries are already waiting, then flush
+		// so the file is current whenever the queue goes quiet.
+		if len(h.entries) > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			slog.Error("Error flushing history", "err", err)
+		}
+	}
+}
+
+// Close flushes anything still buffered and closes the file. Anything
+// recorded afterwards, such as a self-test still running when the web
+// server's shutdown timed out, is logged and dropped.
+func (h *historyLog) Close() {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.entries)
+	}
+	h.mu.Unlock()
+	<-h.done
+}
+
+// Record queues an entry for writing. It never blocks; if the writer has
+// fallen hopelessly behind, the entry is logged and dropped.
+func (h *historyLog) Record(entry HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		slog.Error("History already closed, dropping entry", "jobID", entry.JobID)
+		return
+	}
+
+	select {
+	case h.entries <- entry:
+	default:
+		slog.Error("History buffer full, dropping entry", "jobID", entry.JobID)
+	}
+}
+
+// recordHistory writes entry to the history and counts it towards the
+// maintenance reminders, notifying any it makes due. It must be called
+// without mutex held.
+func recordHistory(entry HistoryEntry) {
+	history.Record(entry)
+
+	mutex.Lock()
+	due := countUsage(entry.Dispenser, entry)
+	if len(due) > 0 {
+		statusChanged()
+	}
+	mutex.Unlock()
+
+	for _, r := range due {
+		slog.Warn("Maintenance due", "dispenser", r.Dispenser, "item", r.Item, "used", r.Used, "threshold", r.Threshold)
+		notifyWebhooks(WebhookEvent{Event: eventMaintenanceDue, Dispenser: r.Dispenser, Reason: r.message()})
+	}
+}
+
+// Read returns every entry at or after since, oldest first.
+func (h *historyLog) Read(since time.Time) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := h.Each(since, func(entry HistoryEntry) {
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// Each calls fn for every entry at or after since, oldest first, without
+// holding the whole file in memory.
+func (h *historyLog) Each(since time.Time, fn func(HistoryEntry)) error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		// A line can be half-written while the writer is mid-flush
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		fn(entry)
+	}
+
+	return scanner.Err()
+}
+
+// historyEntryFor builds the history record for a finished job. The caller
+// must hold mutex.
+func historyEntryFor(job *Job) HistoryEntry {
+	entry := HistoryEntry{
+		JobID:      job.ID,
+		Dispenser:  job.Dispenser,
+		Requested:  job.Requested,
+		Dispensed:  job.Dispensed,
+		JamRetries: job.JamRetries,
+		Splices:    job.Splices,
+		Outcome:    job.State,
+		Stall:      job.Stall,
+	}
+
+	if job.StartedAt != nil {
+		entry.Time = *job.StartedAt
+		if job.FinishedAt != nil {
+			entry.DurationMs = job.FinishedAt.Sub(*job.StartedAt).Milliseconds()
+		}
+	}
+	return entry
+}
+
+// parseSince accepts either an RFC 3339 timestamp or a plain date.
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid since, use RFC 3339 or YYYY-MM-DD")
+		return
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	entries, err := history.Read(since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading history")
+		return
+	}
+
+	// The limit keeps the most recent entries
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func historySummaryHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid since, use RFC 3339 or YYYY-MM-DD")
+		return
+	}
+
+	entries, err := history.Read(since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading history")
+		return
+	}
+
+	days := map[string]*DaySummary{}
+	for _, entry := range entries {
+		if entry.Kind != "" {
+			continue
+		}
+		date := entry.Time.Local().Format("2006-01-02")
+		day, ok := days[date]
+		if !ok {
+			day = &DaySummary{Date: date}
+			days[date] = day
+		}
+		day.Operations++
+		day.Requested += entry.Requested
+		day.Dispensed += entry.Dispensed
+		day.JamRetries += entry.JamRetries
+	}
+
+	summary := make([]DaySummary, 0, len(days))
+	for _, day := range days {
+		summary = append(summary, *day)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Date < summary[j].Date
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
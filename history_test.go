@@ -0,0 +1,28 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryRecordAfterClose(t *testing.T) {
+	h, err := openHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	h.Record(HistoryEntry{JobID: "kept", Time: time.Now()})
+	h.Close()
+	h.Record(HistoryEntry{JobID: "dropped", Time: time.Now()})
+	h.Close()
+
+	entries, err := h.Read(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].JobID != "kept" {
+		t.Errorf("entries = %+v, want only the one recorded before Close", entries)
+	}
+}
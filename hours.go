@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// operatingHours is the daily window dispensing is allowed in, as minutes
+// after local midnight. A window whose close is before its open runs
+// overnight.
+type operatingHours struct {
+	open, close int
+}
+
+// parseOperatingHours reads a window written "09:00-22:00".
+func parseOperatingHours(value string) (operatingHours, error) {
+	openText, closeText, ok := strings.Cut(value, "-")
+	if !ok {
+		return operatingHours{}, fmt.Errorf("%q must look like 09:00-22:00", value)
+	}
+
+	var hours operatingHours
+	for _, part := range []struct {
+		text    string
+		minutes *int
+	}{{openText, &hours.open}, {closeText, &hours.close}} {
+		minutes, err := parseClockTime(part.text)
+		if err != nil {
+			return operatingHours{}, fmt.Errorf("%q must look like 09:00-22:00", value)
+		}
+		*part.minutes = minutes
+	}
+	if hours.open == hours.close {
+		return operatingHours{}, fmt.Errorf("%q opens and closes at the same time; leave it empty to always be open", value)
+	}
+	return hours, nil
+}
+
+// parseClockTime reads a time of day written "07:30" as minutes after
+// local midnight.
+func parseClockTime(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// nextClockTime is the first time after t that the local clock reads
+// minutes after midnight, which is always today or tomorrow.
+func nextClockTime(t time.Time, minutes int) time.Time {
+	t = t.Local()
+	next := time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, time.Local)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, minutes/60, minutes%60, 0, 0, time.Local)
+	}
+	return next
+}
+
+// currentHours is the configured window, and false when the machine is
+// always open. The config has been validated by then.
+func currentHours() (operatingHours, bool) {
+	if config.OperatingHours == "" {
+		return operatingHours{}, false
+	}
+	hours, err := parseOperatingHours(config.OperatingHours)
+	return hours, err == nil
+}
+
+// isOpen reports whether t falls inside the window.
+func (h operatingHours) isOpen(t time.Time) bool {
+	t = t.Local()
+	minute := t.Hour()*60 + t.Minute()
+	if h.open < h.close {
+		return minute >= h.open && minute < h.close
+	}
+	return minute >= h.open || minute < h.close
+}
+
+// opensAfter is the first opening after t, which is always today or
+// tomorrow.
+func (h operatingHours) opensAfter(t time.Time) time.Time {
+	return nextClockTime(t, h.open)
+}
+
+// checkHours refuses a dispense outside operating hours, saying when the
+// machine reopens.
+func checkHours(now time.Time) *refusal {
+	hours, ok := currentHours()
+	if !ok || hours.isOpen(now) {
+		return nil
+	}
+
+	opens := hours.opensAfter(now)
+	when := "at " + opens.Format("15:04")
+	if opens.Day() != now.Local().Day() {
+		when = "tomorrow " + when
+	}
+	return &refusal{http.StatusForbidden, fmt.Sprintf("The machine is closed outside operating hours (%s) and reopens %s", config.OperatingHours, when)}
+}
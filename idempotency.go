@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyMaxLen bounds the keys clients may send.
+const idempotencyKeyMaxLen = 255
+
+// splitTarget stands in for the dispenser of a split request.
+const splitTarget = "*split"
+
+// SeenRequest is a dispense accepted with an idempotency key, kept so a
+// retry of it gets the same answer instead of paying out twice.
+type SeenRequest struct {
+	Key     string `json:"key"`
+	Tickets int    `json:"tickets"`
+	// Target is the dispenser the tickets were asked of, or splitTarget.
+	Target   string          `json:"target"`
+	JobIDs   []string        `json:"jobIds"`
+	Response json.RawMessage `json:"response"`
+	At       time.Time       `json:"at"`
+}
+
+var (
+	// seenRequests is keyed by idempotency key. Guarded by mutex.
+	seenRequests = map[string]*SeenRequest{}
+
+	// seenSaveMu orders saves so an older snapshot can never overwrite a
+	// newer one and forget a key.
+	seenSaveMu sync.Mutex
+)
+
+func loadSeenRequests(path string) error {
+	var stored []*SeenRequest
+	if err := readJSONFile(path, &stored); err != nil {
+		return fmt.Errorf("reading idempotency keys: %w", err)
+	}
+	for _, seen := range stored {
+		seenRequests[seen.Key] = seen
+	}
+	return nil
+}
+
+// saveSeenRequests writes every key still inside the idempotency window to
+// disk and forgets the rest. It must be called without mutex held.
+func saveSeenRequests() {
+	seenSaveMu.Lock()
+	defer seenSaveMu.Unlock()
+
+	mutex.Lock()
+	cutoff := time.Now().Add(-config.IdempotencyWindow.Duration)
+	stored := make([]SeenRequest, 0, len(seenRequests))
+	for key, seen := range seenRequests {
+		if seen.At.Before(cutoff) {
+			delete(seenRequests, key)
+			continue
+		}
+		stored = append(stored, *seen)
+	}
+	mutex.Unlock()
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].At.Before(stored[j].At)
+	})
+	if err := writeJSONFile(config.IdempotencyFile, stored); err != nil {
+		slog.Error("Error saving idempotency keys", "err", err)
+	}
+}
+
+// lookupSeen returns the request already accepted under key, if it is still
+// inside the window. The caller must hold mutex.
+func lookupSeen(key string) *SeenRequest {
+	seen := seenRequests[key]
+	if seen == nil || time.Since(seen.At) > config.IdempotencyWindow.Duration {
+		return nil
+	}
+	return seen
+}
+
+// rememberRequest records the answer to an accepted request. The caller must
+// hold mutex.
+func rememberRequest(key string, tickets int, target string, jobIDs []string, response map[string]interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding response for idempotency key", "err", err)
+		return
+	}
+	seenRequests[key] = &SeenRequest{
+		Key:      key,
+		Tickets:  tickets,
+		Target:   target,
+		JobIDs:   jobIDs,
+		Response: body,
+		At:       time.Now(),
+	}
+}
+
+// replayDispense answers a retry with the original response, brought up to
+// date with where its jobs have got to. A key reused for a different
+// request is refused.
+func replayDispense(w http.ResponseWriter, seen *SeenRequest, tickets int, target string) {
+	if seen.Tickets != tickets || seen.Target != target {
+		writeError(w, http.StatusUnprocessableEntity, "Idempotency key was already used for a different request")
+		return
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(seen.Response, &response); err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading the original response")
+		return
+	}
+	response["replayed"] = true
+
+	mutex.Lock()
+	states := map[string]Job{}
+	for _, id := range seen.JobIDs {
+		if job := findJob(id); job != nil {
+			states[id] = *job
+		}
+	}
+	mutex.Unlock()
+
+	// Jobs that have aged out of the job list are left as they were
+	addState := func(fields map[string]interface{}) {
+		id, _ := fields["jobId"].(string)
+		if job, ok := states[id]; ok {
+			fields["state"] = job.State
+			fields["dispensed"] = job.Dispensed
+		}
+	}
+	addState(response)
+	if jobs, ok := response["jobs"].([]interface{}); ok {
+		for _, item := range jobs {
+			if fields, ok := item.(map[string]interface{}); ok {
+				addState(fields)
+			}
+		}
+	}
+
+	slog.Info("Replayed dispense for a repeated idempotency key", "key", seen.Key, "jobIDs", seen.JobIDs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// startedAt is when the process started, for uptime.
+var startedAt = time.Now()
+
+// InfoResponse identifies the machine to clients that found it over the
+// network.
+type InfoResponse struct {
+	Name          string    `json:"name"`
+	Version       string    `json:"version"`
+	Host          string    `json:"host"`
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	Simulated     bool      `json:"simulated"`
+	DispenserPin  int       `json:"dispenserPin"`
+	SensorPin     int       `json:"sensorPin"`
+	SensorActive  string    `json:"sensorActive"`
+	Limits        Limits    `json:"limits"`
+
+	// Dispensers lists every feeder, first the default. DispenserPin and
+	// SensorPin are the first one's.
+	Dispensers []DispenserConfig `json:"dispensers"`
+}
+
+func infoHandler(w http.ResponseWriter, r *http.Request) {
+	dispensers := config.dispenserConfigs()
+	response := InfoResponse{
+		Name:          config.Name,
+		Version:       version,
+		Host:          config.MDNSHost + ".local",
+		StartedAt:     startedAt,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		Simulated:     config.Simulate,
+		DispenserPin:  dispensers[0].DispenserPin,
+		SensorPin:     dispensers[0].SensorPin,
+		Dispensers:    dispensers,
+		SensorActive:  config.SensorActive,
+		Limits:        currentLimits(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Inventory is a dispenser's estimate of how many tickets are loaded. It is
+// unknown until the first refill is recorded. Loaded is the count that
+// refill set.
+type Inventory struct {
+	Known      bool       `json:"known"`
+	Remaining  int        `json:"remaining"`
+	Loaded     int        `json:"loaded,omitempty"`
+	RefilledAt *time.Time `json:"refilledAt,omitempty"`
+}
+
+var (
+	// inventory holds each dispenser's Inventory by name. Guarded by mutex.
+	inventory = map[string]Inventory{}
+
+	// inventorySaveMu orders saves so an older snapshot can never overwrite
+	// a newer one when two dispensers finish at once and roll the count
+	// back.
+	inventorySaveMu sync.Mutex
+)
+
+// loadInventory reads the inventory file. Files written before machines had
+// several dispensers hold a single Inventory, which belongs to first.
+func loadInventory(path, first string) error {
+	if err := readJSONFile(path, &inventory); err != nil {
+		var single Inventory
+		if readJSONFile(path, &single) != nil {
+			return fmt.Errorf("reading inventory: %w", err)
+		}
+		inventory = map[string]Inventory{first: single}
+	}
+	return nil
+}
+
+// saveInventory writes the current inventory to disk. It must be called
+// without mutex held.
+func saveInventory() {
+	inventorySaveMu.Lock()
+	defer inventorySaveMu.Unlock()
+
+	mutex.Lock()
+	snapshot := maps.Clone(inventory)
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.InventoryFile, snapshot); err != nil {
+		slog.Error("Error saving inventory", "err", err)
+	}
+}
+
+// takeTicket records one ticket leaving the dispenser. The caller must hold
+// mutex.
+func (d *Dispenser) takeTicket() {
+	inv := inventory[d.Name]
+	if inv.Known && inv.Remaining > 0 {
+		inv.Remaining--
+		inventory[d.Name] = inv
+	}
+}
+
+// lowOnTickets reports whether the inventory is under the warning threshold.
+// The caller must hold mutex.
+func (d *Dispenser) lowOnTickets() bool {
+	inv := inventory[d.Name]
+	return inv.Known && inv.Remaining < config.LowTicketThreshold
+}
+
+// availableTickets is what is left once every queued and running job has
+// been paid out, or -1 if the inventory is unknown. The caller must hold
+// mutex.
+func (d *Dispenser) availableTickets() int {
+	inv := inventory[d.Name]
+	if !inv.Known {
+		return -1
+	}
+	available := inv.Remaining - d.pendingTickets()
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// inventoryHandler reports the inventory of the dispenser named by the
+// dispenser query parameter, the first one by default, and records a refill
+// on POST.
+func (s *Server) inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	d := s.find(r.URL.Query().Get("dispenser"))
+	if d == nil {
+		writeError(w, http.StatusNotFound, "Unknown dispenser")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var body struct {
+			Count *int `json:"count"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Count == nil || *body.Count < 0 {
+			writeError(w, http.StatusBadRequest, "Body must be {\"count\": N} with N >= 0")
+			return
+		}
+
+		mutex.Lock()
+		now := time.Now()
+		inventory[d.Name] = Inventory{
+			Known:      true,
+			Remaining:  *body.Count,
+			Loaded:     *body.Count,
+			RefilledAt: &now,
+		}
+
+		// A refill means the feeder has tickets again, whatever the last
+		// few runs suggested.
+		d.clearEmpty()
+		statusChanged()
+		mutex.Unlock()
+
+		saveInventory()
+		slog.Info("Inventory set", "dispenser", d.Name, "tickets", *body.Count)
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	mutex.Lock()
+	snapshot := inventory[d.Name]
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Job states reported by /api/jobs/{id}.
+const (
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobJammed      = "jammed"
+	jobTimeout     = "timeout"
+	jobCancelled   = "cancelled"
+	jobInterrupted = "interrupted"
+	jobFailed      = "failed"
+)
+
+// maxJobHistory is how many finished jobs are kept around for clients that
+// poll late.
+const maxJobHistory = 50
+
+type Job struct {
+	ID         string     `json:"id"`
+	Dispenser  string     `json:"dispenser"`
+	Requested  int        `json:"requested"`
+	Dispensed  int        `json:"dispensed"`
+	JamRetries int        `json:"jamRetries,omitempty"`
+	Splices    int        `json:"splices,omitempty"`
+	State      string     `json:"state"`
+	Stall      string     `json:"stall,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// jobs holds the most recent jobs, oldest first. Guarded by mutex.
+var jobs []*Job
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// addJob records a new job for the named dispenser and drops the oldest once the history is full.
+// The caller must hold mutex.
+func addJob(dispenser string, numTickets int) *Job {
+	job := &Job{
+		ID:        newJobID(),
+		Dispenser: dispenser,
+		Requested: numTickets,
+		State:     jobQueued,
+		CreatedAt: time.Now(),
+	}
+
+	jobs = append(jobs, job)
+	if len(jobs) > maxJobHistory {
+		jobs = jobs[len(jobs)-maxJobHistory:]
+	}
+	return job
+}
+
+// findJob looks up a job by ID. The caller must hold mutex.
+func findJob(id string) *Job {
+	for _, job := range jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// finishJob moves a job into a terminal state. The caller must hold mutex.
+func finishJob(job *Job, state string, dispensed int) {
+	now := time.Now()
+	job.State = state
+	job.Dispensed = dispensed
+	job.FinishedAt = &now
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	job := findJob(r.PathValue("id"))
+	var snapshot Job
+	if job != nil {
+		snapshot = *job
+	}
+	mutex.Unlock()
+
+	if job == nil {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the span config.RateLimit counts requests over.
+const rateWindow = time.Minute
+
+// Limits is what clients need to size their controls.
+type Limits struct {
+	MaxTicketsPerRequest int `json:"maxTicketsPerRequest"`
+	RateLimitPerMinute   int `json:"rateLimitPerMinute,omitempty"`
+	DailyTicketCap       int `json:"dailyTicketCap,omitempty"`
+	// OperatingHours is the daily window dispenses are accepted in, when
+	// there is one.
+	OperatingHours string `json:"operatingHours,omitempty"`
+}
+
+func currentLimits() Limits {
+	return Limits{
+		MaxTicketsPerRequest: config.MaxTicketsPerRequest,
+		RateLimitPerMinute:   config.RateLimit,
+		DailyTicketCap:       config.DailyTicketCap,
+		OperatingHours:       config.OperatingHours,
+	}
+}
+
+// rateLimiter allows each source a fixed number of requests per rateWindow.
+type rateLimiter struct {
+	mu   sync.Mutex
+	hits map[string][]time.Time
+	// swept is when sources without a hit inside the window were last
+	// forgotten.
+	swept time.Time
+}
+
+var limiter = &rateLimiter{hits: map[string][]time.Time{}}
+
+// allow records a request from source and reports whether it is within
+// config.RateLimit. When it isn't, it also returns how long until the
+// source may try again.
+func (l *rateLimiter) allow(source string) (bool, time.Duration) {
+	if config.RateLimit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Once a window, drop every source that has gone quiet, so addresses
+	// that only ever call once don't pile up
+	if now.Sub(l.swept) >= rateWindow {
+		for other, hits := range l.hits {
+			if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= rateWindow {
+				delete(l.hits, other)
+			}
+		}
+		l.swept = now
+	}
+
+	recent := l.hits[source][:0]
+	for _, hit := range l.hits[source] {
+		if now.Sub(hit) < rateWindow {
+			recent = append(recent, hit)
+		}
+	}
+
+	if len(recent) >= config.RateLimit {
+		l.hits[source] = recent
+		return false, rateWindow - now.Sub(recent[0])
+	}
+
+	l.hits[source] = append(recent, now)
+	return true, 0
+}
+
+// rateLimited answers 429 with Retry-After and returns true if the request's
+// source has used up its allowance.
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := limiter.allow(clientIP(r))
+	if ok {
+		return false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, http.StatusTooManyRequests, fmt.Sprintf("Too many requests, try again in %d seconds", seconds))
+	return true
+}
+
+// dailyTally counts the tickets accepted today against config.DailyTicketCap.
+// Guarded by mutex.
+var dailyTally struct {
+	day        string
+	tickets    int
+	overridden bool
+}
+
+// rollDailyTally starts a fresh tally at local midnight. The caller must hold
+// mutex.
+func rollDailyTally() {
+	day := time.Now().Format("2006-01-02")
+	if dailyTally.day != day {
+		dailyTally.day = day
+		dailyTally.tickets = 0
+		dailyTally.overridden = false
+	}
+}
+
+// loadDailyTally seeds today's count from the history so a restart doesn't
+// reset the cap.
+func loadDailyTally() error {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	entries, err := history.Read(midnight)
+	if err != nil {
+		return fmt.Errorf("reading history for the daily cap: %w", err)
+	}
+
+	rollDailyTally()
+	for _, entry := range entries {
+		if entry.Kind != "" {
+			continue
+		}
+		dailyTally.tickets += entry.Requested
+	}
+	return nil
+}
+
+// dailyTicketsLeft is how many more tickets may be accepted today, or -1 if
+// there is no cap or it has been overridden. The caller must hold mutex.
+func dailyTicketsLeft() int {
+	if config.DailyTicketCap <= 0 {
+		return -1
+	}
+	rollDailyTally()
+	if dailyTally.overridden {
+		return -1
+	}
+	return max(config.DailyTicketCap-dailyTally.tickets, 0)
+}
+
+// countTowardsDailyCap records accepted tickets. The caller must hold mutex.
+func countTowardsDailyCap(numTickets int) {
+	rollDailyTally()
+	dailyTally.tickets += numTickets
+}
+
+// refundDailyCap gives back the tickets of a job dropped from the queue
+// before it ran. Only runs reach the history the tally is rebuilt from on a
+// restart, so without the refund the cap left would change across one. A
+// job accepted before midnight counted towards a tally that is already gone.
+// The caller must hold mutex.
+func refundDailyCap(job *Job) {
+	rollDailyTally()
+	if job.CreatedAt.Format("2006-01-02") == dailyTally.day {
+		dailyTally.tickets = max(dailyTally.tickets-job.Requested, 0)
+	}
+}
+
+// overrideHandler lifts the daily cap until midnight.
+func overrideHandler(w http.ResponseWriter, r *http.Request) {
+	if config.DailyTicketCap <= 0 {
+		writeError(w, http.StatusConflict, "No daily cap is configured")
+		return
+	}
+
+	mutex.Lock()
+	rollDailyTally()
+	dailyTally.overridden = true
+	tickets := dailyTally.tickets
+	statusChanged()
+	mutex.Unlock()
+
+	slog.Warn("Daily cap overridden", "client", clientIP(r), "tickets", tickets)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Daily cap lifted until midnight",
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// dailyLeft is how many tickets /api/status says today's cap still allows.
+func dailyLeft(t *testing.T, routes http.Handler) int {
+	t.Helper()
+	left, ok := decodeBody(t, serve(routes, http.MethodGet, "/api/status", "", ""))["dailyTicketsLeft"].(float64)
+	if !ok {
+		t.Fatal("status has no dailyTicketsLeft")
+	}
+	return int(left)
+}
+
+// queue accepts a dispense of tickets and returns its job ID.
+func queue(t *testing.T, routes http.Handler, tickets string) string {
+	t.Helper()
+	w := serve(routes, http.MethodPost, "/api/dispense", "application/json", `{"tickets": `+tickets+`}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("dispense status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	id, _ := decodeBody(t, w)["jobId"].(string)
+	return id
+}
+
+func TestDailyCapRefundsDroppedJobs(t *testing.T) {
+	useTestConfig(t)
+	config.DailyTicketCap = 20
+	srv, routes := newTestRoutes(t)
+	d := srv.dispensers[0]
+
+	id := queue(t, routes, "6")
+	if left := dailyLeft(t, routes); left != 14 {
+		t.Fatalf("after queueing 6: %d left, want 14", left)
+	}
+
+	if w := serve(routes, http.MethodDelete, "/api/jobs/"+id, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if left := dailyLeft(t, routes); left != 20 {
+		t.Errorf("after deleting the job: %d left, want 20", left)
+	}
+
+	queue(t, routes, "5")
+	queue(t, routes, "3")
+	srv.setMaintenance(true, "")
+	srv.setMaintenance(false, "")
+	if left := dailyLeft(t, routes); left != 20 {
+		t.Errorf("after maintenance dropped the queue: %d left, want 20", left)
+	}
+
+	queue(t, routes, "4")
+	srv.idleFeed(d, 3)
+	if left := dailyLeft(t, routes); left != 20 {
+		t.Errorf("after a fault dropped the queue: %d left, want 20", left)
+	}
+	mutex.Lock()
+	fault = Fault{}
+	mutex.Unlock()
+
+	// What a restart would rebuild from the history matches, since none
+	// of those jobs ran
+	mutex.Lock()
+	before := dailyTally.tickets
+	dailyTally.day = ""
+	mutex.Unlock()
+	if err := loadDailyTally(); err != nil {
+		t.Fatal(err)
+	}
+	if dailyTally.tickets != before {
+		t.Errorf("tally rebuilt from history = %d, want %d", dailyTally.tickets, before)
+	}
+}
+
+func TestDailyCapRefundAfterMidnight(t *testing.T) {
+	useTestConfig(t)
+	config.DailyTicketCap = 20
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	countTowardsDailyCap(5)
+	job := addJob("main", 8)
+	job.CreatedAt = job.CreatedAt.Add(-24 * time.Hour)
+	refundDailyCap(job)
+	if left := dailyTicketsLeft(); left != 15 {
+		t.Errorf("refunding yesterday's job: %d left, want 15", left)
+	}
+}
+
+func TestRateLimiterForgetsQuietSources(t *testing.T) {
+	useTestConfig(t)
+	config.RateLimit = 2
+	l := &rateLimiter{hits: map[string][]time.Time{}}
+
+	long := time.Now().Add(-2 * rateWindow)
+	l.hits["192.0.2.1"] = []time.Time{long}
+	l.hits["192.0.2.2"] = []time.Time{long, time.Now()}
+
+	if ok, _ := l.allow("192.0.2.3"); !ok {
+		t.Fatal("first request refused")
+	}
+	if _, kept := l.hits["192.0.2.1"]; kept {
+		t.Error("source with no hit inside the window was kept")
+	}
+	if _, kept := l.hits["192.0.2.2"]; !kept {
+		t.Error("source with a recent hit was forgotten")
+	}
+
+	if ok, _ := l.allow("192.0.2.3"); !ok {
+		t.Fatal("second request refused")
+	}
+	if ok, wait := l.allow("192.0.2.3"); ok || wait <= 0 {
+		t.Errorf("third request: allowed = %v, wait = %v, want refused with a wait", ok, wait)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LogEntry is one log record as /api/logs returns it.
+type LogEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+
+	level slog.Level
+}
+
+// logRing keeps the most recent log records in memory so they can be read
+// back over the API after the terminal that showed them is gone.
+type logRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+var logs = newLogRing(1)
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]LogEntry, size)}
+}
+
+func (r *logRing) add(entry LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Entries returns the most recent entries at or above level, at most limit
+// of them when limit is positive, oldest first.
+func (r *logRing) Entries(level slog.Level, limit int) []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ordered := r.entries[:r.next]
+	if r.full {
+		ordered = append(append([]LogEntry{}, r.entries[r.next:]...), ordered...)
+	}
+
+	entries := []LogEntry{}
+	for _, entry := range ordered {
+		if entry.level >= level {
+			entries = append(entries, entry)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// ringHandler is the slog.Handler that feeds a logRing.
+type ringHandler struct {
+	ring   *logRing
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *ringHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *ringHandler) Handle(_ context.Context, r slog.Record) error {
+	entry := LogEntry{
+		Time:    r.Time,
+		Level:   r.Level.String(),
+		Message: r.Message,
+		level:   r.Level,
+	}
+	if len(h.attrs) > 0 || r.NumAttrs() > 0 {
+		entry.Fields = map[string]any{}
+	}
+	for _, a := range h.attrs {
+		entry.Fields[a.Key] = fieldValue(a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		entry.Fields[h.prefix+a.Key] = fieldValue(a.Value)
+		return true
+	})
+
+	h.ring.add(entry)
+	return nil
+}
+
+func (h *ringHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		next.attrs = append(next.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &next
+}
+
+func (h *ringHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.prefix = h.prefix + name + "."
+	return &next
+}
+
+// fieldValue turns an attribute into something that encodes as JSON the way
+// it reads in the text log: durations and errors as strings.
+func fieldValue(v slog.Value) any {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindGroup:
+		group := map[string]any{}
+		for _, a := range v.Group() {
+			group[a.Key] = fieldValue(a.Value)
+		}
+		return group
+	}
+	if err, ok := v.Any().(error); ok {
+		return err.Error()
+	}
+	return v.Any()
+}
+
+// teeHandler sends every record to each handler that wants it.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(teeHandler, len(t))
+	for i, h := range t {
+		next[i] = h.WithAttrs(attrs)
+	}
+	return next
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	next := make(teeHandler, len(t))
+	for i, h := range t {
+		next[i] = h.WithGroup(name)
+	}
+	return next
+}
+
+// logWriter hands log output to its own goroutine, the same way history
+// does, so logging while holding mutex never waits on a terminal or the
+// disk. If the writer falls hopelessly behind, lines are dropped.
+type logWriter struct {
+	out    io.Writer
+	mu     sync.Mutex
+	closed bool
+	lines  chan []byte
+	done   chan struct{}
+}
+
+func newLogWriter(out io.Writer) *logWriter {
+	w := &logWriter{
+		out:   out,
+		lines: make(chan []byte, 1024),
+		done:  make(chan struct{}),
+	}
+	go w.writer()
+	return w
+}
+
+func (w *logWriter) writer() {
+	defer close(w.done)
+	for line := range w.lines {
+		w.out.Write(line)
+	}
+}
+
+// Write queues one record's output. slog hands over each record in a single
+// call and reuses the buffer afterwards, so it is copied.
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+
+	select {
+	case w.lines <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// Close writes out everything still queued. Anything logged afterwards is
+// only kept in memory.
+func (w *logWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// rotatingFile is an append-only log file that is moved aside to path.1,
+// replacing the one before, once it would grow past maxSize. It is only
+// written from a logWriter, so it needs no lock of its own.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		// A failed rotation leaves no file; try again with the next line
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.file.Close()
+		f.file = nil
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating %s: %v\n", f.path, err)
+		}
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// logOutputs are flushed by closeLogs.
+var (
+	logOutputs []*logWriter
+	logFile    *rotatingFile
+)
+
+// setupLogging makes slog, and the standard log package through it, write
+// text to stderr, JSON to the log file if one is configured and every
+// record to the ring behind /api/logs.
+func setupLogging(c Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	logs = newLogRing(c.LogBuffer)
+	console := newLogWriter(os.Stderr)
+	logOutputs = append(logOutputs, console)
+	handlers := teeHandler{
+		&ringHandler{ring: logs, level: level},
+		slog.NewTextHandler(console, options),
+	}
+
+	if c.LogFile != "" {
+		f, err := openRotatingFile(c.LogFile, c.LogMaxSize*1024*1024)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		logFile = f
+		file := newLogWriter(f)
+		logOutputs = append(logOutputs, file)
+		handlers = append(handlers, slog.NewJSONHandler(file, options))
+	}
+
+	slog.SetDefault(slog.New(handlers))
+	return nil
+}
+
+// closeLogs writes out every queued line and closes the log file.
+func closeLogs() {
+	for _, w := range logOutputs {
+		w.Close()
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+}
+
+// fatal logs why the machine has to stop and exits once the line has been
+// written out.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	closeLogs()
+	os.Exit(1)
+}
+
+// statusRecorder remembers the status code a handler sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush keeps the event stream working through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withRequestLog logs every request once it has been answered. Successful
+// reads are logged at debug level, since the kiosk and metrics scrapers make
+// a steady stream of them.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			level = slog.LevelDebug
+		}
+
+		slog.Log(r.Context(), level, "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+			"client", clientIP(r),
+		)
+	})
+}
+
+// logsHandler returns the most recent log entries, optionally only those at
+// or above ?level= and at most ?limit= of them.
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	level := slog.LevelDebug
+	if value := r.URL.Query().Get("level"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid level, use debug, info, warn or error")
+			return
+		}
+	}
+
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs.Entries(level, limit))
+}
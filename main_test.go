@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// useTestConfig gives a test the default config, sped up so a run takes
+// milliseconds and with every state file in the test's own directory, and
+// clears whatever machine state an earlier test left behind. config is
+// global, so tests that call it can't run in parallel.
+func useTestConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+
+	config = defaultConfig()
+	config.MDNS = false
+	config.TicketTimeout = Duration{100 * time.Millisecond}
+	config.MainTimeout = Duration{5 * time.Second}
+	config.PollInterval = Duration{time.Millisecond}
+	config.JamRetries = 0
+	config.JamBackoff = Duration{10 * time.Millisecond}
+	config.RateLimit = 0
+	config.StaticDir = ""
+	config.HistoryFile = filepath.Join(dir, "history.jsonl")
+	config.FaultFile = filepath.Join(dir, "fault.json")
+	config.InventoryFile = filepath.Join(dir, "inventory.json")
+	config.CodesFile = filepath.Join(dir, "codes.json")
+	config.MaintenanceFile = filepath.Join(dir, "maintenance.json")
+	config.ScheduleFile = filepath.Join(dir, "schedules.json")
+	config.IdempotencyFile = filepath.Join(dir, "idempotency.json")
+	config.SelfTestFile = filepath.Join(dir, "selftests.json")
+	config.ReminderFile = filepath.Join(dir, "reminders.json")
+
+	mutex.Lock()
+	jobs = nil
+	inventory = map[string]Inventory{}
+	codes = map[string]*Code{}
+	schedules = map[string]*Schedule{}
+	seenRequests = map[string]*SeenRequest{}
+	maintenance = Maintenance{}
+	fault = Fault{}
+	selfTestRuns = nil
+	performed = map[string]map[string]time.Time{}
+	usage = map[reminderKey]*reminderUsage{}
+	advised = map[advisoryKey]string{}
+	dailyTally.day = ""
+	mutex.Unlock()
+
+	h, err := openHistory(config.HistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history = h
+	t.Cleanup(h.Close)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maintenance is set while the machine is being serviced. Dispensing is
+// refused until it is cleared, including after a restart.
+type Maintenance struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var (
+	// maintenance is guarded by mutex.
+	maintenance Maintenance
+
+	// maintenanceSaveMu orders saves so an older snapshot can never
+	// overwrite a newer one, and a quick enable then disable can't come
+	// back enabled, or disabled, after a restart.
+	maintenanceSaveMu sync.Mutex
+)
+
+func loadMaintenance(path string) error {
+	if err := readJSONFile(path, &maintenance); err != nil {
+		return fmt.Errorf("reading maintenance state: %w", err)
+	}
+	if maintenance.Enabled {
+		slog.Warn("Starting in maintenance mode", "reason", maintenance.Reason)
+	}
+	return nil
+}
+
+// saveMaintenance writes the maintenance state to disk. It must be called
+// without mutex held.
+func saveMaintenance() {
+	maintenanceSaveMu.Lock()
+	defer maintenanceSaveMu.Unlock()
+
+	mutex.Lock()
+	snapshot := maintenance
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.MaintenanceFile, snapshot); err != nil {
+		slog.Error("Error saving maintenance state", "err", err)
+	}
+}
+
+// maintenanceMessage is what refused requests are told. The caller must
+// hold mutex.
+func maintenanceMessage() string {
+	if maintenance.Reason == "" {
+		return "Ticket machine is in maintenance mode"
+	}
+	return "Ticket machine is in maintenance mode: " + maintenance.Reason
+}
+
+// setMaintenance enters or leaves maintenance mode and saves the change. It
+// must be called without mutex held.
+func (s *Server) setMaintenance(enabled bool, reason string) {
+	mutex.Lock()
+	var stopped []*Dispenser
+	if enabled {
+		now := time.Now()
+		maintenance = Maintenance{
+			Enabled: true,
+			Reason:  strings.TrimSpace(reason),
+			Since:   &now,
+		}
+
+		// Nobody should be reaching into a machine that might start
+		// feeding, so drop the queues and stop whatever is running
+		for _, d := range s.dispensers {
+			d.dropQueued()
+			if d.stop("Entering maintenance...") {
+				stopped = append(stopped, d)
+			} else {
+				d.status = maintenanceMessage()
+			}
+		}
+	} else {
+		maintenance = Maintenance{}
+		for _, d := range s.dispensers {
+			if !d.dispensing {
+				d.status = "Maintenance mode cleared"
+			}
+		}
+	}
+	statusChanged()
+	mutex.Unlock()
+
+	for _, d := range stopped {
+		d.hw.SetLow()
+	}
+	saveMaintenance()
+
+	if enabled {
+		slog.Warn("Maintenance mode enabled", "reason", reason)
+	} else {
+		slog.Info("Maintenance mode cleared")
+	}
+}
+
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body struct {
+			Enabled *bool  `json:"enabled"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeError(w, http.StatusBadRequest, "Body must be {\"enabled\": true|false, \"reason\": \"...\"}")
+			return
+		}
+
+		s.setMaintenance(*body.Enabled, body.Reason)
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	mutex.Lock()
+	response := struct {
+		Maintenance
+		Reminders []Reminder `json:"reminders"`
+	}{maintenance, currentReminders(s.dispensers)}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
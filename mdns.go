@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// mdnsService is the DNS-SD service type staff phones and the companion
+// app browse for.
+const mdnsService = "_ticketmachine._tcp"
+
+// advertise announces the web server over mDNS as config.Name, answering
+// for config.MDNSHost.local. With TLS on, the HTTPS port is the one
+// announced. The returned function withdraws the announcement.
+func advertise() (func(), error) {
+	listen, scheme := config.Listen, "http"
+	if config.TLS {
+		listen, scheme = config.TLSListen, "https"
+	}
+	_, portText, _ := net.SplitHostPort(listen)
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("mDNS needs a numeric port, got %q", portText)
+	}
+
+	ip := localIP()
+	if ip == nil {
+		return nil, fmt.Errorf("no network address to advertise")
+	}
+
+	text := []string{
+		"version=" + version,
+		"path=/",
+		"scheme=" + scheme,
+	}
+
+	server, err := zeroconf.RegisterProxy(config.Name, mdnsService, "local.", port, config.MDNSHost, []string{ip.String()}, text, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting mDNS: %w", err)
+	}
+	slog.Info("Advertising over mDNS", "name", config.Name, "host", config.MDNSHost+".local", "port", port)
+
+	return server.Shutdown, nil
+}
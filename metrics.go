@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feedBuckets are the upper bounds, in seconds, of the per-ticket feed time
+// histogram.
+var feedBuckets = []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 1.5, 2, 3, 5}
+
+// outcomeLabels maps job states to the outcome label on
+// ticket_machine_dispense_operations_total.
+var outcomeLabels = map[string]string{
+	jobDone:        "success",
+	jobJammed:      "jam",
+	jobTimeout:     "timeout",
+	jobCancelled:   "cancelled",
+	jobInterrupted: "interrupted",
+	jobFailed:      "failed",
+}
+
+// dispenseMetrics holds the counters behind /metrics. Gauges are read from
+// the status snapshot at scrape time instead.
+type dispenseMetrics struct {
+	mu         sync.Mutex
+	requested  uint64
+	dispensed  uint64
+	operations map[string]uint64
+	feedCounts []uint64
+	feedSum    float64
+	feedCount  uint64
+}
+
+var metrics = &dispenseMetrics{
+	operations: map[string]uint64{},
+	feedCounts: make([]uint64, len(feedBuckets)),
+}
+
+func (m *dispenseMetrics) addRequested(n int) {
+	m.mu.Lock()
+	m.requested += uint64(n)
+	m.mu.Unlock()
+}
+
+// ticketFed records one dispensed ticket and how long it took to arrive.
+func (m *dispenseMetrics) ticketFed(feedTime time.Duration) {
+	seconds := feedTime.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dispensed++
+	m.feedSum += seconds
+	m.feedCount++
+	for i, bound := range feedBuckets {
+		if seconds <= bound {
+			m.feedCounts[i]++
+		}
+	}
+}
+
+func (m *dispenseMetrics) operationFinished(state string) {
+	outcome, ok := outcomeLabels[state]
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	m.operations[outcome]++
+	m.mu.Unlock()
+}
+
+// machineStates are the values of the machine_state gauge, one series each
+// with the current one at 1.
+var machineStates = []string{"idle", "dispensing", "jammed", "maintenance", "fault"}
+
+// machineState sums up a status as one of machineStates: a fault or
+// maintenance first, since either keeps every motor off, then any dispenser
+// running, then any whose last run jammed.
+func machineState(status StatusResponse) string {
+	switch {
+	case status.Fault:
+		return "fault"
+	case status.Maintenance:
+		return "maintenance"
+	case slices.ContainsFunc(status.Dispensers, func(d DispenserStatus) bool { return d.IsDispensing }):
+		return "dispensing"
+	case slices.ContainsFunc(status.Dispensers, func(d DispenserStatus) bool { return d.Outcome == jobJammed }):
+		return "jammed"
+	}
+	return "idle"
+}
+
+// metricsHandler serves the counters and, as gauges, the same status
+// snapshot /api/status and the event stream are built from, so alerts on
+// the metrics can't disagree with what the UI shows.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	mutex.Lock()
+	status := s.currentStatus()
+	mutex.Unlock()
+
+	metrics.mu.Lock()
+	writeMetric(&b, "ticket_machine_tickets_requested_total", "counter", "Tickets requested across all accepted dispenses.")
+	fmt.Fprintf(&b, "ticket_machine_tickets_requested_total %d\n", metrics.requested)
+
+	writeMetric(&b, "ticket_machine_tickets_dispensed_total", "counter", "Tickets counted by the sensor.")
+	fmt.Fprintf(&b, "ticket_machine_tickets_dispensed_total %d\n", metrics.dispensed)
+
+	writeMetric(&b, "ticket_machine_dispense_operations_total", "counter", "Dispense runs by outcome.")
+	outcomes := make([]string, 0, len(outcomeLabels))
+	for _, outcome := range outcomeLabels {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		fmt.Fprintf(&b, "ticket_machine_dispense_operations_total{outcome=%q} %d\n", outcome, metrics.operations[outcome])
+	}
+
+	writeMetric(&b, "ticket_machine_ticket_feed_seconds", "histogram", "Time between consecutive tickets reaching the sensor, measured from motor start for the first.")
+	for i, bound := range feedBuckets {
+		fmt.Fprintf(&b, "ticket_machine_ticket_feed_seconds_bucket{le=\"%g\"} %d\n", bound, metrics.feedCounts[i])
+	}
+	fmt.Fprintf(&b, "ticket_machine_ticket_feed_seconds_bucket{le=\"+Inf\"} %d\n", metrics.feedCount)
+	fmt.Fprintf(&b, "ticket_machine_ticket_feed_seconds_sum %g\n", metrics.feedSum)
+	fmt.Fprintf(&b, "ticket_machine_ticket_feed_seconds_count %d\n", metrics.feedCount)
+	metrics.mu.Unlock()
+
+	writeMetric(&b, "ticket_machine_dispensing", "gauge", "1 while a dispense is running.")
+	for _, d := range status.Dispensers {
+		fmt.Fprintf(&b, "ticket_machine_dispensing{dispenser=%q} %d\n", d.Name, boolGauge(d.IsDispensing))
+	}
+
+	writeMetric(&b, "ticket_machine_queued_jobs", "gauge", "Dispenses waiting in the queue.")
+	for _, d := range status.Dispensers {
+		fmt.Fprintf(&b, "ticket_machine_queued_jobs{dispenser=%q} %d\n", d.Name, d.Queued)
+	}
+
+	writeMetric(&b, "ticket_machine_tickets_remaining", "gauge", "Estimated tickets left in each dispenser, once a refill has been recorded.")
+	for _, d := range status.Dispensers {
+		if d.Remaining != nil {
+			fmt.Fprintf(&b, "ticket_machine_tickets_remaining{dispenser=%q} %d\n", d.Name, *d.Remaining)
+		}
+	}
+
+	for _, condition := range []struct {
+		name, help string
+		value      func(DispenserStatus) bool
+	}{
+		{"ticket_machine_jam_latched", "1 while the last run of a dispenser ended jammed, until it runs again.", func(d DispenserStatus) bool { return d.Outcome == jobJammed }},
+		{"ticket_machine_likely_empty", "1 while a dispenser is latched as likely out of tickets.", func(d DispenserStatus) bool { return d.LikelyEmpty }},
+		{"ticket_machine_inventory_low", "1 while the inventory of a dispenser is under the low ticket threshold.", func(d DispenserStatus) bool { return d.LowTicket }},
+		{"ticket_machine_inventory_empty", "1 while the inventory of a dispenser is down to no tickets.", func(d DispenserStatus) bool { return d.Remaining != nil && *d.Remaining == 0 }},
+	} {
+		writeMetric(&b, condition.name, "gauge", condition.help)
+		for _, d := range status.Dispensers {
+			fmt.Fprintf(&b, "%s{dispenser=%q} %d\n", condition.name, d.Name, boolGauge(condition.value(d)))
+		}
+	}
+
+	writeMetric(&b, "ticket_machine_maintenance_mode", "gauge", "1 while the machine is in maintenance mode.")
+	fmt.Fprintf(&b, "ticket_machine_maintenance_mode %d\n", boolGauge(status.Maintenance))
+
+	writeMetric(&b, "ticket_machine_maintenance_due", "gauge", "1 while a cleaning or service reminder is due.")
+	fmt.Fprintf(&b, "ticket_machine_maintenance_due %d\n", boolGauge(status.MaintenanceDue))
+
+	writeMetric(&b, "ticket_machine_fault_latched", "gauge", "1 while a fault blocks dispensing, until it is cleared.")
+	fmt.Fprintf(&b, "ticket_machine_fault_latched %d\n", boolGauge(status.Fault))
+
+	writeMetric(&b, "ticket_machine_machine_state", "gauge", "The state the machine is in, as one series per state with the current one at 1.")
+	for _, state := range machineStates {
+		fmt.Fprintf(&b, "ticket_machine_machine_state{state=%q} %d\n", state, boolGauge(state == status.State))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolGauge(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStateMetrics walks the machine through each state and checks the
+// gauges a scrape gives for it.
+func TestStateMetrics(t *testing.T) {
+	useTestConfig(t)
+	config.JamRetries = 0
+	clk := useFakeClock(t)
+	srv, routes := newTestRoutes(t)
+	d := srv.dispensers[0]
+
+	scrape := func() map[string]string {
+		t.Helper()
+		w := serve(routes, http.MethodGet, "/metrics", "", "")
+		gauges := map[string]string{}
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if series, value, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+				gauges[series] = value
+			}
+		}
+		return gauges
+	}
+	check := func(step, state string, want map[string]string) {
+		t.Helper()
+		gauges := scrape()
+		for _, s := range machineStates {
+			value := "0"
+			if s == state {
+				value = "1"
+			}
+			want[`ticket_machine_machine_state{state="`+s+`"}`] = value
+		}
+		mutex.Lock()
+		status := srv.currentStatus().State
+		mutex.Unlock()
+		if status != state {
+			t.Errorf("%s: status state = %q, want %q", step, status, state)
+		}
+		for series, value := range want {
+			if gauges[series] != value {
+				t.Errorf("%s: %s = %q, want %q", step, series, gauges[series], value)
+			}
+		}
+	}
+	conditions := func(jam, low, empty, maintenance, fault string) map[string]string {
+		return map[string]string{
+			`ticket_machine_jam_latched{dispenser="main"}`:     jam,
+			`ticket_machine_likely_empty{dispenser="main"}`:    "0",
+			`ticket_machine_inventory_low{dispenser="main"}`:   low,
+			`ticket_machine_inventory_empty{dispenser="main"}`: empty,
+			"ticket_machine_maintenance_mode":                  maintenance,
+			"ticket_machine_maintenance_due":                   "0",
+			"ticket_machine_fault_latched":                     fault,
+		}
+	}
+
+	check("idle", "idle", conditions("0", "0", "0", "0", "0"))
+
+	// A run whose sensor never moves is dispensing until it gives up, and
+	// then stays jammed until the next run
+	mutex.Lock()
+	job := addJob(d.Name, 2)
+	d.current = job
+	mutex.Unlock()
+	checked := false
+	clk.run(func() { d.runJob(job) }, func(time.Duration) {
+		if !checked {
+			checked = true
+			want := conditions("0", "0", "0", "0", "0")
+			want[`ticket_machine_dispensing{dispenser="main"}`] = "1"
+			check("dispensing", "dispensing", want)
+		}
+	})
+	if !checked {
+		t.Fatal("the run never waited on the clock")
+	}
+	check("jammed", "jammed", conditions("1", "0", "0", "0", "0"))
+
+	mutex.Lock()
+	inventory[d.Name] = Inventory{Known: true, Remaining: config.LowTicketThreshold - 1}
+	mutex.Unlock()
+	check("low", "jammed", conditions("1", "1", "0", "0", "0"))
+
+	mutex.Lock()
+	inventory[d.Name] = Inventory{Known: true}
+	mutex.Unlock()
+	check("empty", "jammed", conditions("1", "1", "1", "0", "0"))
+
+	srv.setMaintenance(true, "test")
+	check("maintenance", "maintenance", conditions("1", "1", "1", "1", "0"))
+
+	mutex.Lock()
+	fault = Fault{Active: true, Reason: idleFeedFault, Dispenser: d.Name}
+	mutex.Unlock()
+	check("fault", "fault", conditions("1", "1", "1", "1", "1"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// SpeedController is implemented by hardware that can run the motor at part
+// speed. It is only used with motorDrive "pwm"; relays that can't be pulsed
+// are only ever switched on and off.
+type SpeedController interface {
+	// SetDuty runs the motor at duty, from just above 0 to 1 for full speed.
+	// SetLow stops it as before.
+	SetDuty(duty float64)
+}
+
+// pwmCycle is the length of a PWM period in clock ticks, so duty cycles are
+// set in hundredths.
+const pwmCycle = 100
+
+func (g *gpioHardware) SetDuty(duty float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.pwm {
+		g.motor.Pwm()
+		g.motor.Freq(config.PWMFrequency * pwmCycle)
+		g.pwm = true
+	}
+	g.motor.DutyCycle(uint32(math.Round(duty*pwmCycle)), pwmCycle)
+}
+
+// motorRamp drives the motor through one dispense run. With PWM it starts
+// at pwmStartDuty and ramps up to pwmRunDuty over pwmRamp every time the
+// motor starts, and drops to pwmSlowDuty for the last ticket so the roll
+// stops cleanly at the perforation. Otherwise it just switches the motor.
+// Once ctx is done it never turns the motor on again.
+type motorRamp struct {
+	ctx   context.Context
+	hw    Hardware
+	speed SpeedController
+
+	started time.Time
+	slow    bool
+	duty    float64
+	// slowest is the lowest duty since the motor started or the last
+	// ticket came out, which is what the wait for the next one is scaled by.
+	slowest float64
+}
+
+func newMotorRamp(ctx context.Context, hw Hardware) *motorRamp {
+	m := &motorRamp{ctx: ctx, hw: hw}
+	if speed, ok := hw.(SpeedController); ok && config.MotorDrive == "pwm" {
+		m.speed = speed
+	}
+	return m
+}
+
+// start runs the motor from rest.
+func (m *motorRamp) start() {
+	if m.speed == nil {
+		m.drive(m.hw.SetHigh)
+		return
+	}
+	m.started = clock.Now()
+	m.duty = 0
+	m.slowest = 1
+	m.update()
+}
+
+// update moves the motor along its ramp. It is called on every poll while
+// the motor runs.
+func (m *motorRamp) update() {
+	if m.speed == nil || m.started.IsZero() {
+		return
+	}
+
+	duty := config.PWMRunDuty
+	if ramp := config.PWMRamp.Duration; ramp > 0 {
+		progress := min(float64(since(m.started))/float64(ramp), 1)
+		duty = config.PWMStartDuty + (config.PWMRunDuty-config.PWMStartDuty)*progress
+	}
+	if m.slow {
+		duty = min(duty, config.PWMSlowDuty)
+	}
+
+	if duty != m.duty {
+		m.drive(func() { m.speed.SetDuty(duty) })
+		m.duty = duty
+	}
+	m.slowest = min(m.slowest, duty)
+}
+
+// drive switches the motor on with set, unless the run has been stopped.
+// Runs are only ever cancelled with mutex held, and whoever cancels drives
+// the motor low after releasing it, so holding mutex here means a ramp step
+// can't land after that and start the motor again.
+func (m *motorRamp) drive(set func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if m.ctx.Err() == nil {
+		set()
+	}
+}
+
+// setSlow switches to the slow speed, for the last ticket of a run.
+func (m *motorRamp) setSlow() {
+	m.slow = true
+	m.update()
+}
+
+// ticketFed starts timing the next ticket at the current speed.
+func (m *motorRamp) ticketFed() {
+	m.slowest = m.duty
+}
+
+// stop stops the motor.
+func (m *motorRamp) stop() {
+	m.hw.SetLow()
+	m.started = time.Time{}
+}
+
+// timeout stretches a wait tuned for full speed to the slowest speed the
+// motor has run at since the last ticket.
+func (m *motorRamp) timeout(full time.Duration) time.Duration {
+	if m.speed == nil || m.slowest <= 0 || m.slowest >= 1 {
+		return full
+	}
+	return time.Duration(float64(full) / m.slowest)
+}
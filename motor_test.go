@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pwmHardware is scriptedHardware with a speed control, recording each
+// duty cycle it is set to.
+type pwmHardware struct {
+	scriptedHardware
+}
+
+func (h *pwmHardware) SetDuty(duty float64) {
+	h.record("duty")
+}
+
+func TestMotorRampStopsDrivingOnceCancelled(t *testing.T) {
+	useTestConfig(t)
+	config.MotorDrive = "pwm"
+	config.PWMRamp = Duration{time.Second}
+	clk := useFakeClock(t)
+
+	hw := &pwmHardware{}
+	ctx, cancel := context.WithCancel(context.Background())
+	motor := newMotorRamp(ctx, hw)
+	motor.start()
+	clk.Advance(10 * time.Millisecond)
+	motor.update()
+	if calls := hw.calls; !slices.Equal(calls, []string{"duty", "duty"}) {
+		t.Fatalf("calls while ramping = %v", calls)
+	}
+
+	// What Cancel does: stop the run, then drive the motor low
+	cancel()
+	hw.SetLow()
+
+	clk.Advance(10 * time.Millisecond)
+	motor.update()
+	motor.setSlow()
+	motor.start()
+	if calls := hw.calls[3:]; len(calls) != 0 {
+		t.Errorf("motor driven after the run was cancelled: %v", calls)
+	}
+	motor.stop()
+	if call := hw.lastCall(); call != "low" {
+		t.Errorf("last call = %q, want the motor left low", call)
+	}
+}
+
+func TestMotorOnOffStartsOnlyWhileRunning(t *testing.T) {
+	useTestConfig(t)
+
+	hw := &scriptedHardware{}
+	ctx, cancel := context.WithCancel(context.Background())
+	motor := newMotorRamp(ctx, hw)
+	motor.start()
+	cancel()
+	motor.start()
+	if !slices.Equal(hw.calls, []string{"high"}) {
+		t.Errorf("calls = %v, want the motor started only before the cancel", hw.calls)
+	}
+}
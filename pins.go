@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// PinReport describes what the safe-state routine did to one pin and the
+// level read back afterwards.
+type PinReport struct {
+	Dispenser string `json:"dispenser"`
+	Name      string `json:"name"`
+	Pin       int    `json:"pin"`
+	Mode      string `json:"mode"`
+	Pull      string `json:"pull,omitempty"`
+	Level     string `json:"level"`
+}
+
+type SafeStateReport struct {
+	Reason string      `json:"reason"`
+	At     time.Time   `json:"at"`
+	Pins   []PinReport `json:"pins"`
+}
+
+var (
+	// safeStateMutex is separate from the dispense mutex so the panic path
+	// can still record a report if it fires while that lock is held.
+	safeStateMutex sync.Mutex
+	lastSafeState  SafeStateReport
+)
+
+// enterSafeState puts every pin of the given dispensers into its inactive
+// state, motor first. It is the only place pins are forced safe: startup and
+// shutdown go through here for every dispenser, panic recovery for the one
+// that failed.
+func enterSafeState(reason string, dispensers ...*Dispenser) SafeStateReport {
+	report := SafeStateReport{
+		Reason: reason,
+		At:     time.Now(),
+	}
+	for _, d := range dispensers {
+		report.Pins = append(report.Pins, d.pins(d.hw.SafeState())...)
+	}
+
+	for _, p := range report.Pins {
+		slog.Info("Safe state", "reason", reason, "dispenser", p.Dispenser, "role", p.Name, "pin", p.Pin, "mode", p.Mode, "pull", p.Pull, "reads", p.Level)
+		// The relay is wired active high, so a motor pin that still reads
+		// high has not taken the write
+		if p.Name == "dispenser" && p.Level == "high" {
+			slog.Error("Motor pin reads high after entering safe state", "dispenser", p.Dispenser, "pin", p.Pin)
+		}
+	}
+
+	safeStateMutex.Lock()
+	lastSafeState = report
+	safeStateMutex.Unlock()
+
+	return report
+}
+
+// pins labels a hardware pin report with the dispenser it belongs to.
+func (d *Dispenser) pins(reports []PinReport) []PinReport {
+	for i := range reports {
+		reports[i].Dispenser = d.Name
+	}
+	return reports
+}
+
+func levelName(state rpio.State) string {
+	if state == rpio.High {
+		return "high"
+	}
+	return "low"
+}
+
+func (s *Server) pinsHandler(w http.ResponseWriter, r *http.Request) {
+	safeStateMutex.Lock()
+	report := lastSafeState
+	safeStateMutex.Unlock()
+
+	var current []PinReport
+	for _, d := range s.dispensers {
+		current = append(current, d.pins(d.hw.Pins())...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"safeState": report,
+		"current":   current,
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields config.PublicStats can expose.
+const (
+	publicTicketsToday   = "ticketsToday"
+	publicTicketsSession = "ticketsSession"
+	publicLargestPayout  = "largestPayout"
+	publicTicketsPerHour = "ticketsPerHour"
+)
+
+var publicStatsFields = []string{publicTicketsToday, publicTicketsSession, publicLargestPayout, publicTicketsPerHour}
+
+// publicStatsTTL is how long the public numbers are reused before the
+// history is read again, so a page left open on a screen all night, or
+// several of them, costs one read of the file every few seconds at most.
+const publicStatsTTL = 15 * time.Second
+
+// publicStatsRefresh is how often the /stats page reloads itself.
+const publicStatsRefresh = 30
+
+// PublicStats is what /api/public-stats and the /stats page show: today's
+// totals, and those since the server started, with only the fields listed
+// in config.PublicStats filled in.
+type PublicStats struct {
+	Machine        string    `json:"machine"`
+	Date           string    `json:"date"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	TicketsToday   *int      `json:"ticketsToday,omitempty"`
+	TicketsSession *int      `json:"ticketsSession,omitempty"`
+	LargestPayout  *int      `json:"largestPayout,omitempty"`
+	// TicketsPerHour is the tickets paid out in each hour of today so far,
+	// from midnight.
+	TicketsPerHour []int `json:"ticketsPerHour,omitempty"`
+}
+
+// publicStatsCache holds the last PublicStats built, for publicStatsTTL.
+var publicStatsCache struct {
+	mu    sync.Mutex
+	built time.Time
+	stats PublicStats
+}
+
+// buildPublicStats totals today and the session that started at session
+// from the history, the same way /api/stats does. It never takes mutex, so
+// it can't hold up a dispense.
+func buildPublicStats(now, session time.Time) (PublicStats, error) {
+	now = now.Local()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	var today, since Stats
+	perHour := make([]int, now.Hour()+1)
+	from := midnight
+	if session.Before(from) {
+		from = session
+	}
+	err := history.Each(from, func(entry HistoryEntry) {
+		if entry.Kind != "" || entry.Time.After(now) {
+			return
+		}
+		if !entry.Time.Before(session) {
+			since.add(entry)
+		}
+		if !entry.Time.Before(midnight) {
+			today.add(entry)
+			perHour[entry.Time.Local().Hour()] += entry.Dispensed
+		}
+	})
+	if err != nil {
+		return PublicStats{}, err
+	}
+
+	stats := PublicStats{Machine: config.Name, Date: midnight.Format("2006-01-02"), UpdatedAt: now}
+	if publicField(publicTicketsToday) {
+		stats.TicketsToday = &today.TicketsDispensed
+	}
+	if publicField(publicTicketsSession) {
+		stats.TicketsSession = &since.TicketsDispensed
+	}
+	if publicField(publicLargestPayout) {
+		stats.LargestPayout = &today.LargestPayout
+	}
+	if publicField(publicTicketsPerHour) {
+		stats.TicketsPerHour = perHour
+	}
+	return stats, nil
+}
+
+func publicField(name string) bool {
+	return slices.Contains(config.PublicStats, name)
+}
+
+// currentPublicStats is the cached PublicStats, rebuilt once it is older
+// than publicStatsTTL.
+func currentPublicStats() (PublicStats, error) {
+	publicStatsCache.mu.Lock()
+	defer publicStatsCache.mu.Unlock()
+
+	now := time.Now()
+	if !publicStatsCache.built.IsZero() && now.Sub(publicStatsCache.built) < publicStatsTTL {
+		return publicStatsCache.stats, nil
+	}
+	stats, err := buildPublicStats(now, startedAt)
+	if err != nil {
+		return PublicStats{}, err
+	}
+	publicStatsCache.built = now
+	publicStatsCache.stats = stats
+	return stats, nil
+}
+
+// publicStatsHandler serves the public numbers as JSON, without an API key.
+func publicStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.PublicStats) == 0 {
+		writeError(w, http.StatusNotFound, "Public stats are turned off")
+		return
+	}
+	stats, err := currentPublicStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading history")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+var publicStatsPage = template.Must(template.New("stats").Funcs(template.FuncMap{
+	"number": func(n *int) string { return groupDigits(*n) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta http-equiv="refresh" content="{{.Refresh}}">
+    <title>{{.Stats.Machine}}</title>
+    <link rel="stylesheet" href="/style.css">
+    <link rel="stylesheet" href="https://fonts.googleapis.com/css2?family=Bangers&family=Poppins:wght@400;600&display=swap">
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Stats.Machine}}</h1>
+        {{- with .Stats.TicketsToday}}
+        <div class="card status-card">
+            <h2>Tickets Dispensed Today</h2>
+            <div class="public-stat">{{number .}}</div>
+        </div>
+        {{- end}}
+        {{- with .Stats.TicketsSession}}
+        <div class="card status-card">
+            <h2>Tickets This Session</h2>
+            <div class="public-stat">{{number .}}</div>
+        </div>
+        {{- end}}
+        {{- with .Stats.LargestPayout}}
+        <div class="card status-card">
+            <h2>Biggest Single Payout</h2>
+            <div class="public-stat">{{number .}}</div>
+        </div>
+        {{- end}}
+        {{- if .Stats.TicketsPerHour}}
+        <div class="card status-card">
+            <h2>Tickets per Hour</h2>
+            <svg class="sparkline" viewBox="0 0 {{.SparkWidth}} 40" preserveAspectRatio="none">
+                <polyline points="{{.Spark}}"/>
+            </svg>
+        </div>
+        {{- end}}
+    </div>
+</body>
+</html>`))
+
+// publicStatsPageHandler renders the public numbers as a page that reloads
+// itself, for a screen by the entrance.
+func publicStatsPageHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.PublicStats) == 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, notFoundPage)
+		return
+	}
+	stats, err := currentPublicStats()
+	if err != nil {
+		http.Error(w, "Error reading history", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Stats      PublicStats
+		Refresh    int
+		Spark      string
+		SparkWidth int
+	}{
+		Stats:      stats,
+		Refresh:    publicStatsRefresh,
+		Spark:      sparkline(stats.TicketsPerHour),
+		SparkWidth: max(len(stats.TicketsPerHour)-1, 1) * 10,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := publicStatsPage.Execute(w, data); err != nil {
+		slog.Error("Error rendering the stats page", "err", err)
+	}
+}
+
+// sparkline is the SVG polyline points for values, 10 units apart and
+// scaled to a height of 40 with the highest at the top.
+func sparkline(values []int) string {
+	highest := 1
+	for _, v := range values {
+		highest = max(highest, v)
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		points[i] = fmt.Sprintf("%d,%.1f", i*10, 40-float64(v)*38/float64(highest))
+	}
+	return strings.Join(points, " ")
+}
+
+// groupDigits writes n with thousands separated by commas, as in 4,812.
+func groupDigits(n int) string {
+	digits := fmt.Sprint(n)
+	for i := len(digits) - 3; i > 0 && digits[i-1] != '-'; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHistory replaces the history file with entries.
+func writeHistory(t *testing.T, entries ...HistoryEntry) {
+	t.Helper()
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for _, entry := range entries {
+		enc.Encode(entry)
+	}
+	if err := os.WriteFile(config.HistoryFile, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildPublicStats(t *testing.T) {
+	useTestConfig(t)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 6, day, hour, minute, 0, 0, time.Local)
+	}
+	writeHistory(t,
+		HistoryEntry{Time: at(31, 23, 0), Requested: 5, Dispensed: 5, Outcome: jobDone},
+		HistoryEntry{Time: at(1, 10, 15), Requested: 30, Dispensed: 30, Outcome: jobDone},
+		HistoryEntry{Time: at(1, 19, 30), Requested: 15, Dispensed: 12, Outcome: jobJammed},
+		HistoryEntry{Time: at(1, 20, 5), Requested: 40, Dispensed: 40, Outcome: jobDone},
+		HistoryEntry{Time: at(1, 20, 10), Kind: historySelfTest, Requested: 1, Dispensed: 1, Outcome: jobDone},
+	)
+	now, session := at(1, 20, 30), at(1, 19, 0)
+
+	stats, err := buildPublicStats(now, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Date != "2026-06-01" || stats.TicketsToday == nil || *stats.TicketsToday != 82 {
+		t.Errorf("stats = %+v, want 82 tickets on 2026-06-01", stats)
+	}
+	if stats.TicketsSession == nil || *stats.TicketsSession != 52 {
+		t.Errorf("session tickets = %v, want 52", stats.TicketsSession)
+	}
+	if stats.LargestPayout == nil || *stats.LargestPayout != 40 {
+		t.Errorf("largest payout = %v, want 40", stats.LargestPayout)
+	}
+	want := make([]int, 21)
+	want[10], want[19], want[20] = 30, 12, 40
+	if !slices.Equal(stats.TicketsPerHour, want) {
+		t.Errorf("tickets per hour = %v, want %v", stats.TicketsPerHour, want)
+	}
+
+	// Only the configured fields are exposed
+	config.PublicStats = []string{publicTicketsToday}
+	stats, err = buildPublicStats(now, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(stats)
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	for _, hidden := range []string{publicTicketsSession, publicLargestPayout, publicTicketsPerHour} {
+		if _, ok := fields[hidden]; ok {
+			t.Errorf("%s exposed in %s", hidden, data)
+		}
+	}
+	if fields[publicTicketsToday] != float64(82) {
+		t.Errorf("ticketsToday = %v, want 82", fields[publicTicketsToday])
+	}
+}
+
+func TestPublicStatsHandlers(t *testing.T) {
+	useTestConfig(t)
+	_, routes := newTestRoutes(t)
+	publicStatsCache.built = time.Time{}
+	t.Cleanup(func() { publicStatsCache.built = time.Time{} })
+
+	w := serve(routes, http.MethodGet, "/stats", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Tickets Dispensed Today") {
+		t.Errorf("GET /stats = %d %q, want the stats page", w.Code, w.Body)
+	}
+	w = serve(routes, http.MethodGet, "/api/public-stats", "", "")
+	if body := decodeBody(t, w); w.Code != http.StatusOK || body["ticketsToday"] != float64(0) {
+		t.Errorf("GET /api/public-stats = %d %v, want 0 tickets today", w.Code, body)
+	}
+
+	config.PublicStats = nil
+	for _, path := range []string{"/stats", "/api/public-stats"} {
+		if w := serve(routes, http.MethodGet, path, "", ""); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d with public stats off, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGroupDigits(t *testing.T) {
+	for n, want := range map[int]string{0: "0", 999: "999", 4812: "4,812", 1234567: "1,234,567", -4812: "-4,812"} {
+		if got := groupDigits(n); got != want {
+			t.Errorf("groupDigits(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// enqueue adds a job to the back of the queue and returns its 1-based
+// position. The caller must hold mutex.
+func (d *Dispenser) enqueue(job *Job) int {
+	d.queue = append(d.queue, job)
+	statusChanged()
+	slog.Info("Job queued", "dispenser", d.Name, "jobID", job.ID, "requested", job.Requested, "position", len(d.queue))
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+
+	return len(d.queue)
+}
+
+// pendingTickets is how many tickets are still owed across the running job
+// and everything queued behind it. The caller must hold mutex.
+func (d *Dispenser) pendingTickets() int {
+	pending := 0
+	if d.current != nil && d.current.FinishedAt == nil {
+		pending += d.current.Requested - d.current.Dispensed
+	}
+	for _, job := range d.queue {
+		pending += job.Requested
+	}
+	return pending
+}
+
+// dropQueued cancels every job waiting for d. The caller must hold mutex.
+func (d *Dispenser) dropQueued() {
+	for _, job := range d.queue {
+		dropJob(job)
+	}
+	d.queue = nil
+}
+
+// dropJob cancels a job that never started and gives its tickets back to
+// today's cap. The caller must hold mutex.
+func dropJob(job *Job) {
+	finishJob(job, jobCancelled, 0)
+	refundDailyCap(job)
+}
+
+// run is the single worker that owns the dispenser. It runs queued jobs one
+// at a time, in the order they were accepted, until shutdown.
+func (d *Dispenser) run() {
+	defer close(d.done)
+
+	for {
+		// A self-test holds the dispenser too, and wakes the worker when
+		// it is done
+		mutex.Lock()
+		for (len(d.queue) == 0 || d.dispensing) && !shuttingDown() {
+			mutex.Unlock()
+			select {
+			case <-d.wake:
+			case <-shutdown:
+			}
+			mutex.Lock()
+		}
+
+		// Jobs still waiting when the server stops are left unstarted
+		if shuttingDown() {
+			mutex.Unlock()
+			return
+		}
+
+		job := d.queue[0]
+		d.queue = d.queue[1:]
+
+		startedAt := time.Now()
+		job.State = jobRunning
+		job.StartedAt = &startedAt
+		d.current = job
+		d.event(slog.LevelInfo, "Starting ticket dispensing...", "requested", job.Requested, "waited", startedAt.Sub(job.CreatedAt))
+		mutex.Unlock()
+
+		notifyWebhooks(WebhookEvent{
+			Event:     eventDispenseStarted,
+			JobID:     job.ID,
+			Dispenser: d.Name,
+			Requested: job.Requested,
+		})
+
+		d.runJob(job)
+
+		mutex.Lock()
+		entry := historyEntryFor(job)
+		statusChanged()
+		mutex.Unlock()
+
+		metrics.operationFinished(entry.Outcome)
+		recordHistory(entry)
+		saveInventory()
+		for _, event := range jobEvents(entry) {
+			notifyWebhooks(event)
+		}
+
+	}
+}
+
+// runJob dispenses one job, making sure a panic stops the motor and fails
+// the job instead of taking the worker down with it.
+func (d *Dispenser) runJob(job *Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			enterSafeState("panic", d)
+
+			mutex.Lock()
+			d.event(slog.LevelError, "Dispensing aborted by an internal error. Motor stopped",
+				"panic", fmt.Sprint(r), "ticketsDispensed", job.Dispensed)
+			finishJob(job, jobFailed, job.Dispensed)
+			mutex.Unlock()
+		}
+	}()
+
+	result, _ := d.Dispense(shutdownCtx, job.Requested)
+
+	mutex.Lock()
+	job.JamRetries = result.JamRetries
+	job.Splices = result.Splices
+	job.Stall = result.Stall
+	finishJob(job, result.Outcome, result.Dispensed)
+	mutex.Unlock()
+}
+
+// deleteJobHandler removes a job from its dispenser's queue before it
+// starts. Running jobs have to be stopped through /api/cancel instead.
+func (s *Server) deleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, d := range s.dispensers {
+		for i, job := range d.queue {
+			if job.ID != id {
+				continue
+			}
+
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			dropJob(job)
+			statusChanged()
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"message": "Job removed from queue",
+				"jobId":   job.ID,
+			})
+			return
+		}
+	}
+
+	if findJob(id) == nil {
+		writeError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	writeError(w, http.StatusConflict, "Job is not queued")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Maintenance items a reminder can be set for: cleaning the feed rollers
+// after config.CleaningTickets tickets, and servicing the dispenser after
+// config.ServiceMotorHours hours of running.
+const (
+	reminderCleaning = "cleaning"
+	reminderService  = "service"
+)
+
+var reminderItems = []string{reminderCleaning, reminderService}
+
+// Reminder is how far one dispenser has got towards one maintenance item.
+// Used and Threshold are tickets for cleaning and motor hours for service.
+type Reminder struct {
+	Item          string     `json:"item"`
+	Dispenser     string     `json:"dispenser"`
+	Unit          string     `json:"unit"`
+	Used          float64    `json:"used"`
+	Threshold     float64    `json:"threshold"`
+	Left          float64    `json:"left"`
+	Due           bool       `json:"due"`
+	LastPerformed *time.Time `json:"lastPerformed,omitempty"`
+}
+
+type reminderKey struct {
+	dispenser, item string
+}
+
+// reminderUsage is what a dispenser has done since an item was last
+// performed, and whether the reminder has been sent since.
+type reminderUsage struct {
+	tickets  int
+	motorMs  int64
+	notified bool
+}
+
+var (
+	// performed is when each item was last done on each dispenser, by
+	// dispenser and then item. Guarded by mutex.
+	performed = map[string]map[string]time.Time{}
+
+	// usage is counted from the history since each item was performed.
+	// Guarded by mutex.
+	usage = map[reminderKey]*reminderUsage{}
+
+	// performedSaveMu orders saves so an older snapshot can never overwrite
+	// a newer one and bring back a counter that was just reset.
+	performedSaveMu sync.Mutex
+)
+
+// reminderThreshold is the configured threshold for item and its unit, with
+// 0 meaning the reminder is off.
+func reminderThreshold(item string) (float64, string) {
+	if item == reminderCleaning {
+		return float64(config.CleaningTickets), "tickets"
+	}
+	return config.ServiceMotorHours, "motorHours"
+}
+
+func (u *reminderUsage) used(item string) float64 {
+	if item == reminderCleaning {
+		return float64(u.tickets)
+	}
+	return time.Duration(u.motorMs * int64(time.Millisecond)).Hours()
+}
+
+// usageFor is the usage behind one reminder. The caller must hold mutex.
+func usageFor(dispenser, item string) *reminderUsage {
+	key := reminderKey{dispenser, item}
+	u, ok := usage[key]
+	if !ok {
+		u = &reminderUsage{}
+		usage[key] = u
+	}
+	return u
+}
+
+// loadReminders reads when each item was last performed and counts the
+// history since, so the counters pick up where they were before a restart.
+// Entries written before machines had several dispensers belong to first.
+// Reminders already due are taken as sent.
+func loadReminders(path, first string) error {
+	if err := readJSONFile(path, &performed); err != nil {
+		return fmt.Errorf("reading reminders: %w", err)
+	}
+
+	err := history.Each(time.Time{}, func(entry HistoryEntry) {
+		dispenser := entry.Dispenser
+		if dispenser == "" {
+			dispenser = first
+		}
+		countUsage(dispenser, entry)
+	})
+	if err != nil {
+		return fmt.Errorf("reading history for reminders: %w", err)
+	}
+
+	for key, u := range usage {
+		threshold, _ := reminderThreshold(key.item)
+		u.notified = threshold > 0 && u.used(key.item) >= threshold
+	}
+	return nil
+}
+
+// savePerformed writes when each item was last performed to disk. It must
+// be called without mutex held.
+func savePerformed() {
+	performedSaveMu.Lock()
+	defer performedSaveMu.Unlock()
+
+	mutex.Lock()
+	snapshot := map[string]map[string]time.Time{}
+	for dispenser, items := range performed {
+		snapshot[dispenser] = maps.Clone(items)
+	}
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.ReminderFile, snapshot); err != nil {
+		slog.Error("Error saving reminders", "err", err)
+	}
+}
+
+// countUsage adds a history entry of dispenser to every reminder performed
+// before it and returns the reminders it made due. Each is only returned
+// once until the item is performed again. The caller must hold mutex.
+func countUsage(dispenser string, entry HistoryEntry) []Reminder {
+	var due []Reminder
+	for _, item := range reminderItems {
+		if entry.Time.Before(performed[dispenser][item]) {
+			continue
+		}
+		u := usageFor(dispenser, item)
+		u.tickets += entry.Dispensed
+		u.motorMs += entry.DurationMs
+
+		if r := reminderFor(dispenser, item); r.Due && !u.notified {
+			u.notified = true
+			due = append(due, r)
+		}
+	}
+	return due
+}
+
+// reminderFor reports one item on one dispenser. The caller must hold
+// mutex.
+func reminderFor(dispenser, item string) Reminder {
+	threshold, unit := reminderThreshold(item)
+	used := usageFor(dispenser, item).used(item)
+	r := Reminder{
+		Item:      item,
+		Dispenser: dispenser,
+		Unit:      unit,
+		Used:      used,
+		Threshold: threshold,
+		Left:      max(threshold-used, 0),
+		Due:       threshold > 0 && used >= threshold,
+	}
+	if at, ok := performed[dispenser][item]; ok {
+		r.LastPerformed = &at
+	}
+	return r
+}
+
+// currentReminders lists every reminder that is turned on, for each
+// dispenser. The caller must hold mutex.
+func currentReminders(dispensers []*Dispenser) []Reminder {
+	reminders := []Reminder{}
+	for _, d := range dispensers {
+		for _, item := range reminderItems {
+			if threshold, _ := reminderThreshold(item); threshold > 0 {
+				reminders = append(reminders, reminderFor(d.Name, item))
+			}
+		}
+	}
+	return reminders
+}
+
+// maintenanceDue reports whether any reminder is due. The caller must hold
+// mutex.
+func maintenanceDue(dispensers []*Dispenser) bool {
+	return slices.ContainsFunc(currentReminders(dispensers), func(r Reminder) bool { return r.Due })
+}
+
+// message describes a due reminder for logs and webhooks.
+func (r Reminder) message() string {
+	if r.Item == reminderCleaning {
+		return fmt.Sprintf("Clean the rollers of %s: %d tickets since the last cleaning", r.Dispenser, int(r.Used))
+	}
+	return fmt.Sprintf("Service %s: %.1f motor hours since the last service", r.Dispenser, r.Used)
+}
+
+// performedHandler records that a maintenance item was done on a dispenser,
+// the first one by default, and starts its counter again.
+func (s *Server) performedHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Item      string `json:"item"`
+		Dispenser string `json:"dispenser"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !slices.Contains(reminderItems, body.Item) {
+		writeError(w, http.StatusBadRequest, "Body must be {\"item\": \"cleaning\"|\"service\", \"dispenser\": \"...\"}")
+		return
+	}
+	d := s.find(body.Dispenser)
+	if d == nil {
+		writeError(w, http.StatusNotFound, "Unknown dispenser")
+		return
+	}
+
+	mutex.Lock()
+	if performed[d.Name] == nil {
+		performed[d.Name] = map[string]time.Time{}
+	}
+	performed[d.Name][body.Item] = time.Now()
+	usage[reminderKey{d.Name, body.Item}] = &reminderUsage{}
+	reminder := reminderFor(d.Name, body.Item)
+	statusChanged()
+	mutex.Unlock()
+
+	savePerformed()
+	slog.Info("Maintenance performed", "dispenser", d.Name, "item", body.Item, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminder)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReminders(t *testing.T) {
+	useTestConfig(t)
+	config.CleaningTickets = 100
+	config.ServiceMotorHours = 1
+	srv, routes := newTestRoutes(t)
+
+	// The cleaning was done after the first run, so only the second counts
+	// towards it, while the service has never been done
+	start := time.Now().Add(-2 * time.Hour)
+	writeHistory(t,
+		HistoryEntry{Time: start, Dispenser: "main", Dispensed: 50, DurationMs: time.Hour.Milliseconds(), Outcome: jobDone},
+		HistoryEntry{Time: start.Add(time.Hour), Dispensed: 30, DurationMs: (20 * time.Minute).Milliseconds(), Outcome: jobDone},
+	)
+	if err := writeJSONFile(config.ReminderFile, map[string]map[string]time.Time{
+		"main": {reminderCleaning: start.Add(30 * time.Minute)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadReminders(config.ReminderFile, "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	reminders := func() map[string]Reminder {
+		t.Helper()
+		w := serve(routes, http.MethodGet, "/api/maintenance", "", "")
+		var body struct {
+			Reminders []Reminder `json:"reminders"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		byItem := map[string]Reminder{}
+		for _, r := range body.Reminders {
+			byItem[r.Item] = r
+		}
+		return byItem
+	}
+	due := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return srv.currentStatus().MaintenanceDue
+	}
+
+	got := reminders()
+	if r := got[reminderCleaning]; r.Used != 30 || r.Left != 70 || r.Due || r.LastPerformed == nil {
+		t.Errorf("cleaning = %+v, want 30 of 100 tickets used", r)
+	}
+	// Already due at startup, so taken as notified
+	if r := got[reminderService]; r.Used != 80.0/60 || !r.Due {
+		t.Errorf("service = %+v, want due after 80 minutes", r)
+	}
+	if !due() {
+		t.Error("status doesn't show maintenance due")
+	}
+
+	// Crossing the cleaning threshold reports it once
+	mutex.Lock()
+	crossed := countUsage("main", HistoryEntry{Time: time.Now(), Dispensed: 70, Outcome: jobDone})
+	again := countUsage("main", HistoryEntry{Time: time.Now(), Dispensed: 5, Outcome: jobDone})
+	mutex.Unlock()
+	if len(crossed) != 1 || crossed[0].Item != reminderCleaning || len(again) != 0 {
+		t.Errorf("newly due = %+v then %+v, want the cleaning once", crossed, again)
+	}
+
+	for _, item := range []string{reminderCleaning, reminderService} {
+		w := serve(routes, http.MethodPost, "/api/maintenance/performed", "application/json", `{"item": "`+item+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("performed %s = %d %s", item, w.Code, w.Body)
+		}
+	}
+	got = reminders()
+	for _, item := range []string{reminderCleaning, reminderService} {
+		if r := got[item]; r.Used != 0 || r.Due || r.LastPerformed == nil {
+			t.Errorf("%s = %+v, want reset", item, r)
+		}
+	}
+	if due() {
+		t.Error("status still shows maintenance due")
+	}
+
+	// A threshold of 0 turns the reminder off
+	config.ServiceMotorHours = 0
+	if _, ok := reminders()[reminderService]; ok {
+		t.Error("service reminder listed with its threshold at 0")
+	}
+
+	if w := serve(routes, http.MethodPost, "/api/maintenance/performed", "application/json", `{"item": "polish"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown item = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSchedules bounds how many dispenses can be waiting for their time.
+const maxSchedules = 100
+
+// Schedule is a dispense that is queued once At comes round.
+type Schedule struct {
+	ID        string    `json:"id"`
+	Tickets   int       `json:"tickets"`
+	Dispenser string    `json:"dispenser"`
+	At        time.Time `json:"at"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+var (
+	// schedules holds the pending schedules by ID. Guarded by mutex.
+	schedules = map[string]*Schedule{}
+
+	// schedulesSaveMu orders saves so an older snapshot can never overwrite
+	// a newer one and bring back a schedule that already ran.
+	schedulesSaveMu sync.Mutex
+
+	// scheduleWake tells the scheduler the pending schedules changed.
+	scheduleWake = make(chan struct{}, 1)
+)
+
+func loadSchedules(path string) error {
+	var stored []*Schedule
+	if err := readJSONFile(path, &stored); err != nil {
+		return fmt.Errorf("reading schedules: %w", err)
+	}
+	for _, schedule := range stored {
+		schedules[schedule.ID] = schedule
+	}
+	return nil
+}
+
+// saveSchedules writes every pending schedule to disk. It must be called
+// without mutex held.
+func saveSchedules() {
+	schedulesSaveMu.Lock()
+	defer schedulesSaveMu.Unlock()
+
+	mutex.Lock()
+	stored := pendingSchedules()
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.ScheduleFile, stored); err != nil {
+		slog.Error("Error saving schedules", "err", err)
+	}
+}
+
+// pendingSchedules lists the schedules soonest first. The caller must hold
+// mutex.
+func pendingSchedules() []Schedule {
+	pending := make([]Schedule, 0, len(schedules))
+	for _, schedule := range schedules {
+		pending = append(pending, *schedule)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].At.Before(pending[j].At)
+	})
+	return pending
+}
+
+func wakeScheduler() {
+	select {
+	case scheduleWake <- struct{}{}:
+	default:
+	}
+}
+
+// runSchedules queues each schedule when its time comes, until shutdown.
+// Schedules that fell due while the machine was off are queued as soon as
+// it starts.
+func (s *Server) runSchedules() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-timer.C:
+		case <-scheduleWake:
+		}
+
+		next, fired := s.fireSchedules(time.Now())
+		if fired {
+			saveSchedules()
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+	}
+}
+
+// fireSchedules queues every schedule due at now and returns when the next
+// one is due, zero if none is left, and whether any were taken off the
+// list.
+func (s *Server) fireSchedules(now time.Time) (time.Time, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var next time.Time
+	fired := false
+	for _, schedule := range pendingSchedules() {
+		if schedule.At.After(now) {
+			next = schedule.At
+			break
+		}
+		delete(schedules, schedule.ID)
+		fired = true
+		s.fireSchedule(schedule, now)
+	}
+	return next, fired
+}
+
+// fireSchedule queues one due schedule through the same checks as any
+// other dispense. One that can't be queued is dropped, not retried. The
+// caller must hold mutex.
+func (s *Server) fireSchedule(schedule Schedule, now time.Time) {
+	fields := []any{"scheduleID", schedule.ID, "requested", schedule.Tickets, "at", schedule.At, "late", now.Sub(schedule.At).Round(time.Second)}
+
+	d := s.find(schedule.Dispenser)
+	if d == nil {
+		slog.Warn("Scheduled dispense dropped, its dispenser is no longer configured", append(fields, "dispenser", schedule.Dispenser)...)
+		return
+	}
+	// Only a schedule that is late, or outlived a change to the hours,
+	// can come due while the machine is closed
+	refused := checkHours(now)
+	var job *Job
+	if refused == nil {
+		job, _, _, refused = admitJob(d, schedule.Tickets)
+	}
+	if refused != nil {
+		slog.Warn("Scheduled dispense refused", append(fields, "dispenser", d.Name, "reason", refused.message)...)
+		return
+	}
+
+	metrics.addRequested(schedule.Tickets)
+	slog.Info("Scheduled dispense queued", append(fields, "dispenser", d.Name, "jobID", job.ID)...)
+}
+
+// scheduleHandler lists pending schedules on GET and creates one on POST
+// with {"tickets": N, "at": "2025-06-01T18:00:00Z"} or {"tickets": N,
+// "delay": 30} for that many seconds from now, and an optional
+// "dispenser".
+func (s *Server) scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		mutex.Lock()
+		pending := pendingSchedules()
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pending)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var body struct {
+		Tickets   int        `json:"tickets"`
+		Dispenser string     `json:"dispenser"`
+		At        *time.Time `json:"at"`
+		Delay     *int       `json:"delay"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Body must be {\"tickets\": N, \"at\": \"2025-06-01T18:00:00Z\"} or {\"tickets\": N, \"delay\": seconds}")
+		return
+	}
+	if body.Tickets <= 0 {
+		writeError(w, http.StatusBadRequest, "Invalid number of tickets")
+		return
+	}
+	if body.Tickets > config.MaxTicketsPerRequest {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("At most %d tickets can be dispensed per request", config.MaxTicketsPerRequest))
+		return
+	}
+	d := s.find(body.Dispenser)
+	if d == nil {
+		writeError(w, http.StatusNotFound, "Unknown dispenser")
+		return
+	}
+
+	now := time.Now()
+	var at time.Time
+	switch {
+	case body.At != nil && body.Delay != nil:
+		writeError(w, http.StatusBadRequest, "Give either at or delay, not both")
+		return
+	case body.At != nil:
+		at = *body.At
+	case body.Delay != nil:
+		if *body.Delay <= 0 {
+			writeError(w, http.StatusBadRequest, "delay must be a positive number of seconds")
+			return
+		}
+		at = now.Add(time.Duration(*body.Delay) * time.Second)
+	default:
+		writeError(w, http.StatusBadRequest, "Missing at or delay")
+		return
+	}
+	if !at.After(now) {
+		writeError(w, http.StatusBadRequest, "at must be in the future")
+		return
+	}
+	if hours, ok := currentHours(); ok && !hours.isOpen(at) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("%s is outside operating hours (%s)", at.Local().Format("2006-01-02 15:04"), config.OperatingHours))
+		return
+	}
+
+	mutex.Lock()
+	if len(schedules) >= maxSchedules {
+		mutex.Unlock()
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("At most %d dispenses can be scheduled at once", maxSchedules))
+		return
+	}
+	schedule := &Schedule{
+		ID:        newJobID(),
+		Tickets:   body.Tickets,
+		Dispenser: d.Name,
+		At:        at,
+		CreatedAt: now,
+	}
+	schedules[schedule.ID] = schedule
+	created := *schedule
+	mutex.Unlock()
+
+	saveSchedules()
+	wakeScheduler()
+	slog.Info("Scheduled a dispense", "scheduleID", created.ID, "dispenser", created.Dispenser, "requested", created.Tickets, "at", created.At)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// deleteScheduleHandler cancels a schedule that hasn't come due yet.
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	mutex.Lock()
+	_, ok := schedules[id]
+	delete(schedules, id)
+	mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown schedule")
+		return
+	}
+
+	saveSchedules()
+	wakeScheduler()
+	slog.Info("Cancelled a scheduled dispense", "scheduleID", id, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Schedule cancelled",
+	})
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// historySelfTest marks history entries written by a self-test, which carry
+// no tickets and are left out of the totals.
+const historySelfTest = "selftest"
+
+// Self-test outcomes besides jobCancelled and jobInterrupted.
+const (
+	selfTestPassed = "passed"
+	selfTestFailed = "failed"
+)
+
+// maxSelfTestRuns bounds the self-test history; the oldest runs go first.
+const maxSelfTestRuns = 200
+
+// selfTestSettle is how long the sensor is watched with the motor off, both
+// before the pulse to check it holds still and after it to catch the
+// trailing edge of a ticket still in front of it.
+const selfTestSettle = 100 * time.Millisecond
+
+// SelfTestReport is the result of pulsing one dispenser's motor and
+// watching its sensor.
+type SelfTestReport struct {
+	Dispenser   string    `json:"dispenser"`
+	StartedAt   time.Time `json:"startedAt"`
+	Baseline    string    `json:"sensorBaseline"`
+	Transitions int       `json:"transitions"`
+	Tickets     int       `json:"tickets"`
+	MotorMs     int64     `json:"motorMs"`
+	ElapsedMs   int64     `json:"elapsedMs"`
+	Passed      bool      `json:"passed"`
+	// Outcome is "passed" or "failed", or the job state for a test that
+	// was cancelled or interrupted.
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+	// Dispense is the single ticket a scheduled test pays out after a pass
+	// when config.SelfTestDispense is set.
+	Dispense *SelfTestDispense `json:"testDispense,omitempty"`
+}
+
+// SelfTestDispense is how the test dispense of a scheduled self-test went.
+type SelfTestDispense struct {
+	Dispensed int    `json:"dispensed"`
+	Outcome   string `json:"outcome"`
+	Passed    bool   `json:"passed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// finished reports whether the test ran to a verdict, rather than being
+// cancelled or interrupted.
+func (r SelfTestReport) finished() bool {
+	return r.Outcome == selfTestPassed || r.Outcome == selfTestFailed
+}
+
+// ok reports whether the dispenser passed, test dispense included.
+func (r SelfTestReport) ok() bool {
+	return r.Passed && (r.Dispense == nil || r.Dispense.Passed)
+}
+
+// SelfTestRun is one entry of the self-test history: the reports of every
+// dispenser tested together, by hand or on schedule.
+type SelfTestRun struct {
+	Time      time.Time        `json:"time"`
+	Scheduled bool             `json:"scheduled"`
+	Passed    bool             `json:"passed"`
+	Reports   []SelfTestReport `json:"reports"`
+}
+
+var (
+	// selfTestRuns is the self-test history, oldest first. Guarded by
+	// mutex.
+	selfTestRuns []SelfTestRun
+
+	// selfTestsSaveMu orders saves so an older snapshot can never overwrite
+	// a newer one and lose a run.
+	selfTestsSaveMu sync.Mutex
+)
+
+func loadSelfTests(path string) error {
+	if err := readJSONFile(path, &selfTestRuns); err != nil {
+		return fmt.Errorf("reading self-tests: %w", err)
+	}
+	return nil
+}
+
+// saveSelfTests writes the self-test history to disk. It must be called
+// without mutex held.
+func saveSelfTests() {
+	selfTestsSaveMu.Lock()
+	defer selfTestsSaveMu.Unlock()
+
+	mutex.Lock()
+	snapshot := append([]SelfTestRun(nil), selfTestRuns...)
+	mutex.Unlock()
+
+	if err := writeJSONFile(config.SelfTestFile, snapshot); err != nil {
+		slog.Error("Error saving self-tests", "err", err)
+	}
+}
+
+// recordSelfTestRun adds a run to the self-test history, saves it and sends
+// its notifications. It must be called without mutex held.
+func recordSelfTestRun(run SelfTestRun) {
+	run.Passed = len(run.Reports) > 0
+	for _, report := range run.Reports {
+		run.Passed = run.Passed && report.ok()
+	}
+
+	mutex.Lock()
+	notify := selfTestEvents(run)
+	selfTestRuns = append(selfTestRuns, run)
+	if len(selfTestRuns) > maxSelfTestRuns {
+		selfTestRuns = selfTestRuns[len(selfTestRuns)-maxSelfTestRuns:]
+	}
+	mutex.Unlock()
+
+	saveSelfTests()
+	for _, event := range notify {
+		notifyWebhooks(event)
+	}
+}
+
+// selfTestEvents are the notifications for a run about to be recorded: a
+// dispenser that fails is reported every time, and one that passes only
+// when its previous finished test failed, so a machine that keeps passing
+// stays quiet. The caller must hold mutex.
+func selfTestEvents(run SelfTestRun) []WebhookEvent {
+	var events []WebhookEvent
+	for _, report := range run.Reports {
+		if !report.finished() {
+			continue
+		}
+		event := WebhookEvent{Dispenser: report.Dispenser, Outcome: report.Outcome, Reason: report.Reason}
+		if report.Dispense != nil && !report.Dispense.Passed {
+			event.Outcome = report.Dispense.Outcome
+			event.Reason = report.Dispense.Reason
+		}
+		switch {
+		case !report.ok():
+			event.Event = eventSelfTestFailed
+			events = append(events, event)
+		case previouslyFailed(report.Dispenser):
+			event.Event = eventSelfTestRecovered
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// previouslyFailed reports whether the last finished self-test of the
+// named dispenser failed. The caller must hold mutex.
+func previouslyFailed(dispenser string) bool {
+	for i := len(selfTestRuns) - 1; i >= 0; i-- {
+		for _, report := range selfTestRuns[i].Reports {
+			if report.Dispenser == dispenser && report.finished() {
+				return !report.ok()
+			}
+		}
+	}
+	return false
+}
+
+// SelfTest reads the sensor's resting level, runs the motor for pulse and
+// checks the sensor moved while it did. It takes the dispenser exactly like
+// a dispense would, so it refuses with errBusy while one is running, queued
+// jobs wait for it and Cancel stops it. Like a dispense, it is refused with
+// a *refusal while the machine is faulted or in maintenance. The error is
+// only set when the test could not run at all.
+func (d *Dispenser) SelfTest(ctx context.Context, pulse time.Duration) (SelfTestReport, error) {
+	report := SelfTestReport{Dispenser: d.Name, StartedAt: clock.Now(), Outcome: selfTestFailed}
+
+	mutex.Lock()
+	if d.dispensing {
+		mutex.Unlock()
+		return report, errBusy
+	}
+	if refused := checkMotors(); refused != nil {
+		mutex.Unlock()
+		return report, refused
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	d.dispensing = true
+	d.cancel = cancel
+	d.event(slog.LevelInfo, "Self-test running...", "pulse", pulse)
+	mutex.Unlock()
+
+	defer func() {
+		mutex.Lock()
+		fields := []any{"outcome", report.Outcome, "transitions", report.Transitions, "tickets", report.Tickets, "motorMs", report.MotorMs}
+		if report.Passed {
+			d.event(slog.LevelInfo, "Self-test passed: "+report.Reason, fields...)
+		} else {
+			d.event(slog.LevelWarn, "Self-test failed: "+report.Reason, fields...)
+		}
+		d.dispensing = false
+		d.cancel = nil
+		mutex.Unlock()
+
+		// The worker holds off while the dispenser is taken, so let it
+		// look at the queue again
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	d.hw.SetLow()
+	// The motor goes through the same ramp as a dispense, so it runs at
+	// the configured duty and can't be switched on once the test is
+	// cancelled
+	motor := newMotorRamp(ctx, d.hw)
+	sensor := newSensorWatcher(d.hw)
+	defer sensor.stop()
+	report.Baseline = levelName(d.hw.ReadSensor())
+
+	// watch polls the sensor until the window passes or ctx is done,
+	// returning the transitions it saw.
+	watch := func(window time.Duration) []bool {
+		var changes []bool
+		deadline := clock.Now().Add(window)
+		for ctx.Err() == nil && clock.Now().Before(deadline) {
+			motor.update()
+			changes = append(changes, sensor.poll()...)
+			clock.Sleep(config.PollInterval.Duration)
+		}
+		return changes
+	}
+
+	if restless := len(watch(selfTestSettle)); restless > 0 && ctx.Err() == nil {
+		report.Transitions = restless
+		report.Reason = fmt.Sprintf("Sensor changed %d time(s) with the motor off, check its wiring and alignment", restless)
+		report.ElapsedMs = since(report.StartedAt).Milliseconds()
+		return report, nil
+	}
+
+	var changes []bool
+	if ctx.Err() == nil {
+		motorStart := clock.Now()
+		motor.start()
+		changes = watch(pulse)
+		motor.stop()
+		report.MotorMs = since(motorStart).Milliseconds()
+		changes = append(changes, watch(selfTestSettle)...)
+	}
+	d.hw.SetLow()
+
+	report.Transitions = len(changes)
+	mutex.Lock()
+	for _, active := range changes {
+		// Whatever fully passed the sensor has left the feeder
+		if !active {
+			report.Tickets++
+			d.takeTicket()
+		}
+	}
+	mutex.Unlock()
+	report.ElapsedMs = since(report.StartedAt).Milliseconds()
+
+	switch stopped := context.Cause(ctx); {
+	case errors.Is(stopped, errShuttingDown):
+		report.Outcome = jobInterrupted
+		report.Reason = "Interrupted by shutdown"
+	case stopped != nil:
+		report.Outcome = jobCancelled
+		report.Reason = "Cancelled"
+	case report.Transitions == 0:
+		report.Reason = fmt.Sprintf("No sensor transition while the motor ran for %dms, check the relay, motor and sensor", report.MotorMs)
+	default:
+		report.Passed = true
+		report.Outcome = selfTestPassed
+		report.Reason = fmt.Sprintf("%d sensor transition(s) in %dms", report.Transitions, report.MotorMs)
+	}
+	return report, nil
+}
+
+// runScheduledSelfTests self-tests every dispenser each day at
+// config.SelfTestAt until shutdown.
+func (s *Server) runScheduledSelfTests() {
+	at, _ := parseClockTime(config.SelfTestAt)
+	for {
+		next := nextClockTime(time.Now(), at)
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(time.Until(next)):
+		}
+		s.scheduledSelfTest(time.Now())
+	}
+}
+
+// skipSelfTest is why a scheduled self-test can't run at now, or empty if
+// it can. The caller must hold mutex.
+func (s *Server) skipSelfTest(now time.Time) string {
+	if refused := checkMotors(); refused != nil {
+		return refused.message
+	}
+	for _, d := range s.dispensers {
+		if d.dispensing || len(d.queue) > 0 {
+			return fmt.Sprintf("Dispenser %s has a job active", d.Name)
+		}
+	}
+	if config.SelfTestDispense && config.QuietHours != "" {
+		quiet, _ := parseOperatingHours(config.QuietHours)
+		if quiet.isOpen(now) {
+			return fmt.Sprintf("Quiet hours (%s) forbid the test dispense", config.QuietHours)
+		}
+	}
+	return ""
+}
+
+// scheduledSelfTest self-tests every dispenser in turn, pays out a test
+// ticket from each that passed when config.SelfTestDispense is set, and
+// records the run. It is skipped, with the reason logged, when a job is
+// active, the machine is in maintenance or faulted, or quiet hours are on
+// and it would dispense. It reports whether the run went ahead.
+func (s *Server) scheduledSelfTest(now time.Time) bool {
+	mutex.Lock()
+	reason := s.skipSelfTest(now)
+	mutex.Unlock()
+	if reason != "" {
+		slog.Warn("Scheduled self-test skipped", "reason", reason)
+		return false
+	}
+
+	run := SelfTestRun{Time: now, Scheduled: true}
+	for _, d := range s.dispensers {
+		report, err := d.SelfTest(shutdownCtx, config.SelfTestPulse.Duration)
+		if err != nil {
+			// A job or maintenance got in since the check, so what was
+			// tested is kept and the rest left for tomorrow
+			slog.Warn("Scheduled self-test stopped", "dispenser", d.Name, "reason", err)
+			break
+		}
+		recordSelfTestEntry(report)
+
+		if report.Passed && config.SelfTestDispense {
+			report.Dispense = d.testDispense()
+		}
+		run.Reports = append(run.Reports, report)
+		if !report.finished() {
+			break
+		}
+	}
+	if len(run.Reports) > 0 {
+		recordSelfTestRun(run)
+	}
+	return true
+}
+
+// testDispense pays out a single ticket outside the queue, as part of a
+// scheduled self-test. It returns nil if a job took the dispenser first.
+func (d *Dispenser) testDispense() *SelfTestDispense {
+	startedAt := clock.Now()
+	result, err := d.Dispense(shutdownCtx, 1)
+	if errors.Is(err, errBusy) {
+		slog.Warn("Test dispense skipped, a job got in first", "dispenser", d.Name)
+		return nil
+	}
+
+	recordHistory(HistoryEntry{
+		Time:       startedAt,
+		Kind:       historySelfTest,
+		Dispenser:  d.Name,
+		Requested:  1,
+		Dispensed:  result.Dispensed,
+		Outcome:    result.Outcome,
+		Stall:      result.Stall,
+		DurationMs: since(startedAt).Milliseconds(),
+	})
+	saveInventory()
+
+	dispense := &SelfTestDispense{Dispensed: result.Dispensed, Outcome: result.Outcome, Passed: err == nil}
+	if err != nil {
+		dispense.Reason = "Test dispense: " + err.Error()
+	}
+	return dispense
+}
+
+// recordSelfTestEntry keeps a self-test in the dispense history, outside the
+// ticket totals, and saves the tickets it fed off the inventory.
+func recordSelfTestEntry(report SelfTestReport) {
+	recordHistory(HistoryEntry{
+		Time:       report.StartedAt,
+		Kind:       historySelfTest,
+		Dispenser:  report.Dispenser,
+		Outcome:    report.Outcome,
+		DurationMs: report.ElapsedMs,
+	})
+	saveInventory()
+}
+
+// selfTestHistoryHandler lists past self-test runs, oldest first, keeping
+// only the most recent ?limit= of them.
+func selfTestHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	mutex.Lock()
+	runs := append([]SelfTestRun{}, selfTestRuns...)
+	mutex.Unlock()
+	if limit > 0 && len(runs) > limit {
+		runs = runs[len(runs)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// selfTestHandler runs a self-test on the dispenser named by the dispenser
+// parameter, the first one by default, and records it in the history and
+// the self-test history.
+func (s *Server) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	d := s.find(r.FormValue("dispenser"))
+	if d == nil {
+		writeError(w, http.StatusNotFound, "Unknown dispenser")
+		return
+	}
+	if shuttingDown() {
+		writeError(w, http.StatusServiceUnavailable, "Ticket machine is shutting down")
+		return
+	}
+
+	report, err := d.SelfTest(shutdownCtx, config.SelfTestPulse.Duration)
+	var refused *refusal
+	switch {
+	case errors.Is(err, errBusy):
+		writeError(w, http.StatusConflict, "Dispenser is busy, try again once it has finished")
+		return
+	case errors.As(err, &refused):
+		writeError(w, refused.status, refused.message)
+		return
+	}
+
+	recordSelfTestEntry(report)
+	recordSelfTestRun(SelfTestRun{Time: report.StartedAt, Reports: []SelfTestReport{report}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	useTestConfig(t)
+	clk := useFakeClock(t)
+	hw := &scriptedHardware{script: feed(2, 100*time.Millisecond, 15*time.Millisecond)}
+	d := newDispenser("main", hw)
+
+	var report SelfTestReport
+	clk.run(func() { report, _ = d.SelfTest(context.Background(), 300*time.Millisecond) }, nil)
+
+	if !report.Passed || report.Outcome != selfTestPassed || report.Transitions != 4 || report.Tickets != 2 {
+		t.Errorf("report = %+v, want passed with 2 tickets", report)
+	}
+	if report.MotorMs != 300 || report.Baseline != "low" {
+		t.Errorf("report = %+v, want a 300ms pulse from a low baseline", report)
+	}
+	if call := hw.lastCall(); call != "low" {
+		t.Errorf("last motor call = %q, want the motor left low", call)
+	}
+}
+
+func TestSelfTestRampsPWMMotor(t *testing.T) {
+	useTestConfig(t)
+	config.MotorDrive = "pwm"
+	clk := useFakeClock(t)
+	hw := &pwmHardware{}
+	d := newDispenser("main", hw)
+
+	clk.run(func() { d.SelfTest(context.Background(), 500*time.Millisecond) }, nil)
+
+	hw.mu.Lock()
+	calls := slices.Clone(hw.calls)
+	hw.mu.Unlock()
+	if slices.Contains(calls, "high") {
+		t.Errorf("calls = %v, want the motor driven at the PWM duty rather than full on", calls)
+	}
+	if duties := slices.Index(calls, "duty"); duties < 0 || len(calls) < duties+3 {
+		t.Errorf("calls = %v, want the motor ramped over several duty cycles", calls)
+	}
+	if call := hw.lastCall(); call != "low" {
+		t.Errorf("last motor call = %q, want the motor left low", call)
+	}
+}
+
+func TestSelfTestCancelled(t *testing.T) {
+	useTestConfig(t)
+	config.MotorDrive = "pwm"
+	config.PWMRamp = Duration{time.Second}
+	clk := useFakeClock(t)
+	hw := &pwmHardware{}
+	d := newDispenser("main", hw)
+
+	var report SelfTestReport
+	calls := 0
+	clk.run(func() { report, _ = d.SelfTest(context.Background(), 500*time.Millisecond) }, func(elapsed time.Duration) {
+		if elapsed >= selfTestSettle+200*time.Millisecond && calls == 0 {
+			d.Cancel()
+			hw.mu.Lock()
+			calls = len(hw.calls)
+			hw.mu.Unlock()
+		}
+	})
+
+	if report.Outcome != jobCancelled {
+		t.Errorf("Outcome = %q, want %q", report.Outcome, jobCancelled)
+	}
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	for _, call := range hw.calls[calls:] {
+		if call != "low" {
+			t.Errorf("calls after the cancel = %v, want the motor only driven low", hw.calls[calls:])
+			break
+		}
+	}
+}
+
+func TestSelfTestHandlerRefused(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(srv *Server)
+		wantError string
+	}{
+		{
+			name:      "maintenance",
+			setup:     func(srv *Server) { srv.setMaintenance(true, "refilling") },
+			wantError: "Ticket machine is in maintenance mode: refilling",
+		},
+		{
+			name: "fault",
+			setup: func(srv *Server) {
+				mutex.Lock()
+				fault = Fault{Active: true, Reason: idleFeedFault, Dispenser: "main"}
+				mutex.Unlock()
+			},
+			wantError: idleFeedFault + ". Clear it with POST /api/fault/clear once the machine has been checked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			srv, routes := newTestRoutes(t)
+			hw := srv.dispensers[0].hw.(*scriptedHardware)
+			tt.setup(srv)
+
+			w := serve(routes, http.MethodPost, "/api/selftest", "", "")
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+			}
+			if body := decodeBody(t, w); body["error"] != tt.wantError {
+				t.Errorf("error = %v, want %q", body["error"], tt.wantError)
+			}
+			if calls := hw.calls; len(calls) != 0 {
+				t.Errorf("motor calls = %v, want the motor left alone", calls)
+			}
+		})
+	}
+}
+
+func TestScheduledSelfTest(t *testing.T) {
+	useTestConfig(t)
+	config.SelfTestDispense = true
+	config.TicketTimeout = Duration{time.Second}
+	clk := useFakeClock(t)
+	// One ticket while the self-test pulses the motor and another once the
+	// test dispense has started it again
+	script := append(feed(1, 100*time.Millisecond, 15*time.Millisecond), feed(1, 700*time.Millisecond, 15*time.Millisecond)...)
+	hw := &scriptedHardware{script: script}
+	srv := newServer([]*Dispenser{newDispenser("main", hw)})
+
+	ran := false
+	clk.run(func() { ran = srv.scheduledSelfTest(clk.Now()) }, nil)
+
+	if !ran {
+		t.Fatal("scheduled self-test skipped")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(selfTestRuns) != 1 {
+		t.Fatalf("got %d self-test runs, want 1", len(selfTestRuns))
+	}
+	run := selfTestRuns[0]
+	if !run.Scheduled || !run.Passed || len(run.Reports) != 1 {
+		t.Fatalf("run = %+v, want one scheduled report that passed", run)
+	}
+	if dispense := run.Reports[0].Dispense; dispense == nil || !dispense.Passed || dispense.Dispensed != 1 {
+		t.Errorf("test dispense = %+v, want 1 ticket paid out", dispense)
+	}
+	if call := hw.lastCall(); call != "low" {
+		t.Errorf("last motor call = %q, want the motor left low", call)
+	}
+}
+
+func TestScheduledSelfTestSkipped(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(srv *Server)
+	}{
+		{"maintenance", func(srv *Server) { srv.setMaintenance(true, "refilling") }},
+		{"fault", func(srv *Server) {
+			mutex.Lock()
+			fault = Fault{Active: true, Reason: idleFeedFault, Dispenser: "main"}
+			mutex.Unlock()
+		}},
+		{"job queued", func(srv *Server) {
+			mutex.Lock()
+			srv.dispensers[0].enqueue(addJob("main", 5))
+			mutex.Unlock()
+		}},
+		{"quiet hours", func(srv *Server) {
+			config.SelfTestDispense = true
+			config.QuietHours = "00:00-23:59"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			hw := &scriptedHardware{}
+			srv := newServer([]*Dispenser{newDispenser("main", hw)})
+			tt.setup(srv)
+
+			if srv.scheduledSelfTest(time.Date(2026, 6, 1, 12, 0, 0, 0, time.Local)) {
+				t.Error("scheduled self-test ran, want it skipped")
+			}
+			if calls := hw.calls; len(calls) != 0 {
+				t.Errorf("motor calls = %v, want the motor left alone", calls)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(selfTestRuns) != 0 {
+				t.Errorf("self-test runs = %+v, want none recorded", selfTestRuns)
+			}
+		})
+	}
+}
+
+func TestSelfTestNotifications(t *testing.T) {
+	useTestConfig(t)
+	report := func(outcome string) SelfTestReport {
+		return SelfTestReport{Dispenser: "main", Outcome: outcome, Passed: outcome == selfTestPassed}
+	}
+
+	steps := []struct {
+		report SelfTestReport
+		want   []string
+	}{
+		{report(selfTestPassed), nil},
+		{report(selfTestFailed), []string{eventSelfTestFailed}},
+		{report(selfTestFailed), []string{eventSelfTestFailed}},
+		{report(jobCancelled), nil},
+		{report(selfTestPassed), []string{eventSelfTestRecovered}},
+		{report(selfTestPassed), nil},
+		{SelfTestReport{Dispenser: "main", Outcome: selfTestPassed, Passed: true, Dispense: &SelfTestDispense{Outcome: jobJammed}}, []string{eventSelfTestFailed}},
+	}
+	for i, step := range steps {
+		run := SelfTestRun{Reports: []SelfTestReport{step.report}}
+		mutex.Lock()
+		var got []string
+		for _, event := range selfTestEvents(run) {
+			got = append(got, event.Event)
+		}
+		mutex.Unlock()
+		if !slices.Equal(got, step.want) {
+			t.Errorf("step %d (%s): events = %v, want %v", i, step.report.Outcome, got, step.want)
+		}
+		recordSelfTestRun(run)
+	}
+
+	w := serve(http.HandlerFunc(selfTestHistoryHandler), http.MethodGet, "/api/selftest/history?limit=2", "", "")
+	var runs []SelfTestRun
+	if err := json.NewDecoder(w.Body).Decode(&runs); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || !runs[0].Passed || runs[1].Passed {
+		t.Errorf("history = %+v, want the last pass and the failed test dispense", runs)
+	}
+
+	selfTestRuns = nil
+	if err := loadSelfTests(config.SelfTestFile); err != nil || len(selfTestRuns) != len(steps) {
+		t.Errorf("reloaded %d runs (%v), want %d", len(selfTestRuns), err, len(steps))
+	}
+}
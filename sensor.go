@@ -0,0 +1,93 @@
+package main
+
+import "github.com/stianeikeland/go-rpio/v4"
+
+// EdgeDetector is implemented by hardware that can latch sensor edges in
+// between reads. With the latch, a notch that passes the sensor faster than
+// the poll interval still registers instead of being missed.
+type EdgeDetector interface {
+	// StartEdgeDetection arms the latch for both edges of the sensor.
+	StartEdgeDetection()
+	// EdgeDetected reports whether an edge has been latched since the last
+	// call, clearing the latch.
+	EdgeDetected() bool
+	// StopEdgeDetection disarms the latch.
+	StopEdgeDetection()
+}
+
+func (g *gpioHardware) StartEdgeDetection() {
+	g.sensor.Detect(rpio.AnyEdge)
+	// Clear anything latched before the run started
+	g.sensor.EdgeDetected()
+}
+
+func (g *gpioHardware) EdgeDetected() bool {
+	return g.sensor.EdgeDetected()
+}
+
+func (g *gpioHardware) StopEdgeDetection() {
+	g.sensor.Detect(rpio.NoEdge)
+}
+
+// sensorWatcher turns sensor readings into transitions of the ticket pulse.
+// The sensor is "active" while a notch is in front of it, which is High or
+// Low depending on the sensor; config.SensorActive picks which. It has to be
+// polled: go-rpio's edge detection is a latch register that can be read, with
+// no way to block until an edge arrives.
+type sensorWatcher struct {
+	hw     Hardware
+	edges  EdgeDetector
+	active rpio.State
+	last   bool
+}
+
+// newSensorWatcher arms edge detection when the hardware supports it and
+// config allows it, otherwise it falls back to comparing plain reads.
+func newSensorWatcher(hw Hardware) *sensorWatcher {
+	w := newPollingSensorWatcher(hw)
+	if detector, ok := hw.(EdgeDetector); ok && config.EdgeDetection {
+		w.edges = detector
+		w.edges.StartEdgeDetection()
+	}
+	w.last = w.isActive()
+	return w
+}
+
+// newPollingSensorWatcher only ever compares plain reads. It leaves the edge
+// latch alone, so it can watch the sensor alongside a run that owns it.
+func newPollingSensorWatcher(hw Hardware) *sensorWatcher {
+	w := &sensorWatcher{hw: hw, active: rpio.High}
+	if config.SensorActive == "low" {
+		w.active = rpio.Low
+	}
+	w.last = w.isActive()
+	return w
+}
+
+func (w *sensorWatcher) isActive() bool {
+	return w.hw.ReadSensor() == w.active
+}
+
+// poll returns every change of the pulse since the last call, oldest first,
+// as the new active state after each change. When the latch caught an edge
+// but the level reads back unchanged, a whole pulse passed between polls and
+// both of its transitions are reported.
+func (w *sensorWatcher) poll() []bool {
+	latched := w.edges != nil && w.edges.EdgeDetected()
+	current := w.isActive()
+
+	var changes []bool
+	if current != w.last {
+		changes = []bool{current}
+	} else if latched {
+		changes = []bool{!current, current}
+	}
+	w.last = current
+	return changes
+}
+
+func (w *sensorWatcher) stop() {
+	if w.edges != nil {
+		w.edges.StopEdgeDetection()
+	}
+}
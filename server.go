@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Server is the HTTP API and web UI in front of the machine's dispensers.
+// The first dispenser is the default for requests that don't name one.
+type Server struct {
+	dispensers []*Dispenser
+}
+
+func newServer(dispensers []*Dispenser) *Server {
+	return &Server{dispensers: dispensers}
+}
+
+// find looks up a dispenser by name, with an empty name meaning the first.
+// It returns nil for an unknown name.
+func (s *Server) find(name string) *Dispenser {
+	if name == "" {
+		return s.dispensers[0]
+	}
+	for _, d := range s.dispensers {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// routes builds the mux for every endpoint, with static serving the web UI.
+func (s *Server) routes(static http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", static)
+
+	mux.HandleFunc("/api/", apiNotFound)
+	mux.HandleFunc("/api/dispense", requireAPIKey(s.dispenseHandler))
+	mux.HandleFunc("POST /api/dispense/preview", requireAPIKey(s.previewHandler))
+	mux.HandleFunc("/api/status", s.statusHandler)
+	mux.HandleFunc("GET /api/events", eventsHandler)
+	mux.HandleFunc("/api/cancel", requireAPIKey(s.cancelHandler))
+	mux.HandleFunc("GET /api/jobs/{id}", jobHandler)
+	mux.HandleFunc("DELETE /api/jobs/{id}", requireAPIKey(s.deleteJobHandler))
+	mux.HandleFunc("/api/pins", s.pinsHandler)
+	mux.HandleFunc("GET /api/config", configHandler)
+	mux.HandleFunc("GET /metrics", s.metricsHandler)
+	mux.HandleFunc("/api/inventory", requireAPIKey(s.inventoryHandler))
+	mux.HandleFunc("GET /api/history", historyHandler)
+	mux.HandleFunc("GET /api/history/summary", historySummaryHandler)
+	mux.HandleFunc("GET /api/stats", statsHandler)
+	mux.HandleFunc("GET /api/public-stats", publicStatsHandler)
+	mux.HandleFunc("GET /stats", publicStatsPageHandler)
+	mux.HandleFunc("/api/maintenance", requireAPIKey(s.maintenanceHandler))
+	mux.HandleFunc("POST /api/maintenance/performed", requireAPIKey(s.performedHandler))
+	mux.HandleFunc("POST /api/fault/clear", requireAPIKey(s.faultClearHandler))
+	mux.HandleFunc("POST /api/selftest", requireAPIKey(s.selfTestHandler))
+	mux.HandleFunc("GET /api/selftest/history", selfTestHistoryHandler)
+	mux.HandleFunc("GET /api/info", infoHandler)
+	mux.HandleFunc("GET /api/logs", requireAPIKeyAlways(logsHandler))
+	mux.HandleFunc("/api/codes", requireAPIKeyAlways(codesHandler))
+	mux.HandleFunc("/api/redeem", s.redeemHandler)
+	mux.HandleFunc("POST /api/limits/override", requireAPIKey(overrideHandler))
+	mux.HandleFunc("/api/schedule", requireAPIKey(s.scheduleHandler))
+	mux.HandleFunc("DELETE /api/schedule/{id}", requireAPIKey(deleteScheduleHandler))
+	mux.HandleFunc("GET /api/webhooks/test", requireAPIKeyAlways(webhookTestHandler))
+	return mux
+}
+
+// StatusResponse is the machine status. The embedded DispenserStatus is the
+// first dispenser, as it was before machines could have several, and
+// Dispensers lists every one.
+type StatusResponse struct {
+	DispenserStatus
+	Dispensers []DispenserStatus `json:"dispensers"`
+
+	// DailyLeft is how many more tickets today's cap allows, when there is
+	// one in force.
+	DailyLeft *int `json:"dailyTicketsLeft,omitempty"`
+
+	Maintenance       bool   `json:"maintenance"`
+	MaintenanceReason string `json:"maintenanceReason,omitempty"`
+	// MaintenanceDue is set while a cleaning or service reminder is due.
+	MaintenanceDue bool `json:"maintenanceDue"`
+
+	// Fault is set while a fault blocks dispensing, until it is cleared
+	// with POST /api/fault/clear.
+	Fault       bool   `json:"fault"`
+	FaultReason string `json:"faultReason,omitempty"`
+
+	// Advisories lists the soft thresholds crossed ahead of the daily cap
+	// and running out of tickets.
+	Advisories []Advisory `json:"advisories,omitempty"`
+
+	// State sums up faults, maintenance and the dispensers as one of
+	// machineStates.
+	State string `json:"state"`
+}
+
+func (s *Server) dispenseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	req, err := readDispenseRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d, invalid := s.checkRequest(req)
+	if invalid != nil {
+		writeError(w, invalid.status, invalid.message)
+		return
+	}
+	target := d.Name
+	if req.Split {
+		target = splitTarget
+	}
+
+	// A retry of a request that got through is answered before the rate
+	// limit, which it would otherwise count against
+	key := req.IdempotencyKey
+	if key != "" {
+		mutex.Lock()
+		seen := lookupSeen(key)
+		mutex.Unlock()
+		if seen != nil {
+			replayDispense(w, seen, req.Tickets, target)
+			return
+		}
+	}
+
+	if rateLimited(w, r) {
+		return
+	}
+
+	if refused := checkHours(time.Now()); refused != nil {
+		if !req.Override {
+			writeError(w, refused.status, refused.message)
+			return
+		}
+		slog.Warn("Dispensing outside operating hours on an admin override", "client", clientIP(r), "requested", req.Tickets)
+	}
+
+	mutex.Lock()
+	// Another try of the same request may have got in meanwhile
+	if seen := lookupSeen(key); seen != nil {
+		mutex.Unlock()
+		replayDispense(w, seen, req.Tickets, target)
+		return
+	}
+
+	var response map[string]interface{}
+	var jobIDs []string
+	var refused *refusal
+	if req.Split {
+		var placed []placement
+		var warning string
+		placed, warning, refused = admitSplit(s.dispensers, req.Tickets)
+		if refused == nil {
+			response = splitResponse(req.Tickets, placed, warning)
+			for _, p := range placed {
+				jobIDs = append(jobIDs, p.job.ID)
+			}
+		}
+	} else {
+		var job *Job
+		var position int
+		var warning string
+		job, position, warning, refused = admitJob(d, req.Tickets)
+		if refused == nil {
+			response = acceptedResponse(job, position, warning)
+			jobIDs = []string{job.ID}
+		}
+	}
+	if refused == nil && key != "" {
+		rememberRequest(key, req.Tickets, target, jobIDs, response)
+	}
+	mutex.Unlock()
+
+	if refused != nil {
+		writeError(w, refused.status, refused.message)
+		return
+	}
+	if key != "" {
+		saveSeenRequests()
+	}
+
+	metrics.addRequested(req.Tickets)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// previewHandler answers whether a dispense with the same body would be
+// accepted now, through the same checks, without queuing anything. It also
+// lists the advisories the dispense would leave in force, so integrations
+// can hold back before the hard limits refuse them.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readDispenseRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d, invalid := s.checkRequest(req)
+	if invalid != nil {
+		writeError(w, invalid.status, invalid.message)
+		return
+	}
+
+	refused := checkHours(time.Now())
+	if req.Override {
+		refused = nil
+	}
+
+	mutex.Lock()
+	warning := ""
+	var shares map[string]int
+	if refused == nil {
+		if req.Split {
+			_, shares, warning, refused = planSplit(s.dispensers, req.Tickets)
+		} else {
+			warning, refused = planJob(d, req.Tickets)
+			shares = map[string]int{d.Name: req.Tickets}
+		}
+	}
+	if refused != nil {
+		shares = nil
+	}
+	advisories := advisoriesAfter(s.dispensers, shares)
+	mutex.Unlock()
+
+	response := map[string]interface{}{
+		"allowed":    refused == nil,
+		"advisories": append([]Advisory{}, advisories...),
+	}
+	if refused != nil {
+		response["reason"] = refused.message
+	}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkRequest turns away a dispense request that could never be accepted,
+// and otherwise returns the dispenser it names.
+func (s *Server) checkRequest(req dispenseRequest) (*Dispenser, *refusal) {
+	if req.Tickets <= 0 {
+		return nil, &refusal{http.StatusBadRequest, "Invalid number of tickets"}
+	}
+	if req.Tickets > config.MaxTicketsPerRequest {
+		return nil, &refusal{http.StatusBadRequest, fmt.Sprintf("At most %d tickets can be dispensed per request", config.MaxTicketsPerRequest)}
+	}
+
+	d := s.find(req.Dispenser)
+	if d == nil {
+		return nil, &refusal{http.StatusNotFound, "Unknown dispenser"}
+	}
+	return d, nil
+}
+
+// dispenseRequest is what POST /api/dispense asks for. Dispenser picks the
+// feeder, the first by default, and Split lets the tickets go to whichever
+// feeders can pay them out soonest instead. IdempotencyKey, when set, makes
+// retries of the same request safe. Override dispenses outside operating
+// hours.
+type dispenseRequest struct {
+	Tickets        int
+	Dispenser      string
+	Split          bool
+	IdempotencyKey string
+	Override       bool
+}
+
+// readDispenseRequest reads either a JSON body ({"tickets": 10}) or the form
+// encoding the web UI sends, depending on Content-Type. The idempotency key
+// may come in the Idempotency-Key header or as idempotency_key in the body,
+// the header winning.
+func readDispenseRequest(r *http.Request) (dispenseRequest, error) {
+	var req dispenseRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body struct {
+			Tickets        *int   `json:"tickets"`
+			Dispenser      string `json:"dispenser"`
+			Split          bool   `json:"split"`
+			IdempotencyKey string `json:"idempotency_key"`
+			Override       bool   `json:"override"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return req, errors.New("Malformed JSON body, expected {\"tickets\": N}")
+		}
+		if body.Tickets == nil {
+			return req, errors.New("Missing tickets")
+		}
+		req = dispenseRequest{*body.Tickets, body.Dispenser, body.Split, body.IdempotencyKey, body.Override}
+	} else {
+		numTickets, err := strconv.Atoi(r.FormValue("tickets"))
+		if err != nil {
+			return req, errors.New("Invalid number of tickets")
+		}
+		split := false
+		if value := r.FormValue("split"); value != "" {
+			if split, err = strconv.ParseBool(value); err != nil {
+				return req, errors.New("Invalid split, use true or false")
+			}
+		}
+		override := false
+		if value := r.FormValue("override"); value != "" {
+			if override, err = strconv.ParseBool(value); err != nil {
+				return req, errors.New("Invalid override, use true or false")
+			}
+		}
+		req = dispenseRequest{numTickets, r.FormValue("dispenser"), split, r.FormValue("idempotency_key"), override}
+	}
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+	if len(req.IdempotencyKey) > idempotencyKeyMaxLen {
+		return req, fmt.Errorf("Idempotency key must be at most %d characters", idempotencyKeyMaxLen)
+	}
+	return req, nil
+}
+
+// refusal is why a dispense request was turned away, as an HTTP status and
+// message.
+type refusal struct {
+	status  int
+	message string
+}
+
+func (r *refusal) Error() string {
+	return r.message
+}
+
+// checkMotors refuses anything that would run a motor while the machine is
+// faulted or in maintenance. The caller must hold mutex.
+func checkMotors() *refusal {
+	if fault.Active {
+		return &refusal{http.StatusServiceUnavailable, fault.Reason + ". Clear it with POST /api/fault/clear once the machine has been checked"}
+	}
+
+	if maintenance.Enabled {
+		return &refusal{http.StatusServiceUnavailable, maintenanceMessage()}
+	}
+	return nil
+}
+
+// checkMachine runs the checks that apply to a request whichever dispenser
+// it goes to. The caller must hold mutex.
+func checkMachine(numTickets int) *refusal {
+	if shuttingDown() {
+		return &refusal{http.StatusServiceUnavailable, "Ticket machine is shutting down"}
+	}
+
+	if refused := checkMotors(); refused != nil {
+		return refused
+	}
+
+	if left := dailyTicketsLeft(); left >= 0 && numTickets > left {
+		message := fmt.Sprintf("Today's limit of %d tickets has been reached. An admin override is needed to dispense more", config.DailyTicketCap)
+		if left > 0 {
+			message = fmt.Sprintf("Only %d tickets left under today's limit of %d", left, config.DailyTicketCap)
+		}
+		return &refusal{http.StatusForbidden, message}
+	}
+	return nil
+}
+
+// planJob runs the checks every dispense request goes through for
+// numTickets on d, without queuing anything, and returns any inventory
+// warning. The caller must hold mutex.
+func planJob(d *Dispenser, numTickets int) (string, *refusal) {
+	if refused := checkMachine(numTickets); refused != nil {
+		return "", refused
+	}
+
+	if len(d.queue) >= config.MaxQueue {
+		return "", &refusal{http.StatusTooManyRequests, "Too many dispenses queued, try again shortly"}
+	}
+
+	warning := ""
+	if available := d.availableTickets(); available >= 0 && numTickets > available {
+		if config.InventoryPolicy == "refuse" {
+			return "", &refusal{http.StatusConflict, fmt.Sprintf("Only %d tickets left in the machine", available)}
+		}
+		warning = fmt.Sprintf("Only %d tickets left, this request may not be paid out in full", available)
+	}
+	return warning, nil
+}
+
+// admitJob queues a job for numTickets on d if planJob lets it through. It
+// returns the job, its queue position and any inventory warning. The caller
+// must hold mutex.
+func admitJob(d *Dispenser, numTickets int) (*Job, int, string, *refusal) {
+	warning, refused := planJob(d, numTickets)
+	if refused != nil {
+		return nil, 0, "", refused
+	}
+
+	job := addJob(d.Name, numTickets)
+	position := d.enqueue(job)
+	countTowardsDailyCap(numTickets)
+	raiseAdvisories([]*Dispenser{d})
+	return job, position, warning, nil
+}
+
+// placement is the part of a split request queued on one dispenser.
+type placement struct {
+	job      *Job
+	position int
+}
+
+// planSplit works out how numTickets are spread across dispensers, fastest
+// available first: the dispensers owing the fewest tickets take as many as
+// they have left, and whatever no inventory covers goes to the quickest one
+// regardless. It returns the tickets by dispenser name, in the order they
+// are queued, without queuing anything. The caller must hold mutex.
+func planSplit(dispensers []*Dispenser, numTickets int) ([]*Dispenser, map[string]int, string, *refusal) {
+	if refused := checkMachine(numTickets); refused != nil {
+		return nil, nil, "", refused
+	}
+
+	var candidates []*Dispenser
+	for _, d := range dispensers {
+		if len(d.queue) < config.MaxQueue {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, "", &refusal{http.StatusTooManyRequests, "Too many dispenses queued, try again shortly"}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].pendingTickets() < candidates[j].pendingTickets()
+	})
+
+	shares := map[string]int{}
+	left := numTickets
+	for _, d := range candidates {
+		share := left
+		if available := d.availableTickets(); available >= 0 {
+			share = min(share, available)
+		}
+		shares[d.Name] = share
+		left -= share
+	}
+
+	warning := ""
+	if left > 0 {
+		available := numTickets - left
+		if config.InventoryPolicy == "refuse" {
+			return nil, nil, "", &refusal{http.StatusConflict, fmt.Sprintf("Only %d tickets left in the machine", available)}
+		}
+		warning = fmt.Sprintf("Only %d tickets left, this request may not be paid out in full", available)
+		shares[candidates[0].Name] += left
+	}
+	return candidates, shares, warning, nil
+}
+
+// admitSplit queues numTickets across dispensers as planSplit spreads them.
+// The caller must hold mutex.
+func admitSplit(dispensers []*Dispenser, numTickets int) ([]placement, string, *refusal) {
+	candidates, shares, warning, refused := planSplit(dispensers, numTickets)
+	if refused != nil {
+		return nil, "", refused
+	}
+
+	var placed []placement
+	for _, d := range candidates {
+		if shares[d.Name] == 0 {
+			continue
+		}
+		job := addJob(d.Name, shares[d.Name])
+		placed = append(placed, placement{job, d.enqueue(job)})
+	}
+	countTowardsDailyCap(numTickets)
+	raiseAdvisories(dispensers)
+	return placed, warning, nil
+}
+
+// acceptedResponse is the body sent back once a dispense has been queued.
+func acceptedResponse(job *Job, position int, warning string) map[string]interface{} {
+	response := map[string]interface{}{
+		"message":   fmt.Sprintf("Queued %d tickets", job.Requested),
+		"jobId":     job.ID,
+		"dispenser": job.Dispenser,
+		"position":  position,
+	}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	return response
+}
+
+// splitResponse is the body sent back once a split dispense has been
+// queued. jobId is the first job, for clients that only follow one.
+func splitResponse(numTickets int, placed []placement, warning string) map[string]interface{} {
+	jobs := make([]map[string]interface{}, len(placed))
+	for i, p := range placed {
+		jobs[i] = map[string]interface{}{
+			"jobId":     p.job.ID,
+			"dispenser": p.job.Dispenser,
+			"tickets":   p.job.Requested,
+			"position":  p.position,
+		}
+	}
+
+	response := map[string]interface{}{
+		"message": fmt.Sprintf("Queued %d tickets across %d dispenser(s)", numTickets, len(placed)),
+		"jobId":   placed[0].job.ID,
+		"jobs":    jobs,
+	}
+	if warning != "" {
+		response["warning"] = warning
+	}
+	return response
+}
+
+func (s *Server) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Without a dispenser named, everything running is stopped
+	name := r.FormValue("dispenser")
+	if s.find(name) == nil {
+		writeError(w, http.StatusNotFound, "Unknown dispenser")
+		return
+	}
+	stopped := false
+	for _, d := range s.dispensers {
+		if name == "" || d.Name == name {
+			stopped = d.Cancel() || stopped
+		}
+	}
+	if !stopped {
+		writeError(w, http.StatusConflict, "Nothing is dispensing")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Cancelling dispense",
+	})
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	response := s.currentStatus()
+	mutex.Unlock()
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// currentStatus snapshots the machine state for /api/status and the event
+// stream. The caller must hold mutex.
+func (s *Server) currentStatus() StatusResponse {
+	response := StatusResponse{
+		Dispensers:     make([]DispenserStatus, len(s.dispensers)),
+		Maintenance:    maintenance.Enabled,
+		MaintenanceDue: maintenanceDue(s.dispensers),
+		Fault:          fault.Active,
+	}
+	for i, d := range s.dispensers {
+		response.Dispensers[i] = d.snapshot()
+	}
+	response.DispenserStatus = response.Dispensers[0]
+
+	if maintenance.Enabled {
+		response.MaintenanceReason = maintenance.Reason
+	}
+	if fault.Active {
+		response.FaultReason = fault.Reason
+	}
+	if left := dailyTicketsLeft(); left >= 0 {
+		response.DailyLeft = &left
+	}
+	response.Advisories = advisoriesAfter(s.dispensers, nil)
+	response.State = machineState(response)
+	return response
+}
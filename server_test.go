@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRoutes serves the API for a single dispenser on scripted hardware.
+// Its queue has no worker, so accepted jobs stay queued.
+func newTestRoutes(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	static, err := newStaticHandler(config.StaticDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer([]*Dispenser{newDispenser("main", &scriptedHardware{})})
+	return srv, srv.routes(static)
+}
+
+// serve sends one request through handler and returns the recorded
+// response.
+func serve(handler http.Handler, method, path, contentType, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// decodeBody decodes a JSON response body into a map.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+func TestDispenseHandler(t *testing.T) {
+	useTestConfig(t)
+	_, routes := newTestRoutes(t)
+
+	w := serve(routes, http.MethodPost, "/api/dispense", "application/json", `{"tickets": 3}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	body := decodeBody(t, w)
+	if body["message"] != "Queued 3 tickets" || body["dispenser"] != "main" || body["position"] != 1.0 {
+		t.Errorf("body = %v", body)
+	}
+	id, _ := body["jobId"].(string)
+
+	w = serve(routes, http.MethodGet, "/api/jobs/"+id, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("job status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if job := decodeBody(t, w); job["state"] != jobQueued || job["requested"] != 3.0 {
+		t.Errorf("job = %v", job)
+	}
+
+	// The web UI posts a form rather than JSON
+	w = serve(routes, http.MethodPost, "/api/dispense", "application/x-www-form-urlencoded", "tickets=2")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("form status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	if body := decodeBody(t, w); body["position"] != 2.0 {
+		t.Errorf("form position = %v, want 2", body["position"])
+	}
+}
+
+func TestDispenseHandlerRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		wantStatus  int
+		wantError   string
+	}{
+		{"malformed JSON", http.MethodPost, "application/json", `{"tickets": `, http.StatusBadRequest, "Malformed JSON body, expected {\"tickets\": N}"},
+		{"missing tickets", http.MethodPost, "application/json", `{}`, http.StatusBadRequest, "Missing tickets"},
+		{"no tickets", http.MethodPost, "application/json", `{"tickets": 0}`, http.StatusBadRequest, "Invalid number of tickets"},
+		{"too many tickets", http.MethodPost, "application/json", `{"tickets": 101}`, http.StatusBadRequest, "At most 100 tickets can be dispensed per request"},
+		{"unknown dispenser", http.MethodPost, "application/json", `{"tickets": 1, "dispenser": "side"}`, http.StatusNotFound, "Unknown dispenser"},
+		{"wrong method", http.MethodGet, "", "", http.StatusMethodNotAllowed, "Method not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t)
+			_, routes := newTestRoutes(t)
+
+			w := serve(routes, tt.method, "/api/dispense", tt.contentType, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if body := decodeBody(t, w); body["error"] != tt.wantError {
+				t.Errorf("error = %v, want %q", body["error"], tt.wantError)
+			}
+		})
+	}
+}
+
+func TestCancelHandler(t *testing.T) {
+	useTestConfig(t)
+	srv, routes := newTestRoutes(t)
+
+	w := serve(routes, http.MethodPost, "/api/cancel", "", "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("idle cancel status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if body := decodeBody(t, w); body["error"] != "Nothing is dispensing" {
+		t.Errorf("idle cancel error = %v", body["error"])
+	}
+
+	clk := useFakeClock(t)
+	d := srv.dispensers[0]
+	d.hw = &scriptedHardware{script: feed(1, 15*time.Millisecond, 15*time.Millisecond)}
+	config.TicketTimeout = Duration{time.Second}
+	cancelled := false
+	result, _ := clk.dispense(d, 5, func(elapsed time.Duration) {
+		if elapsed >= 200*time.Millisecond && !cancelled {
+			cancelled = true
+			w = serve(routes, http.MethodPost, "/api/cancel", "", "")
+		}
+	})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("cancel status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := decodeBody(t, w); body["message"] != "Cancelling dispense" {
+		t.Errorf("cancel body = %v", body)
+	}
+	if result.Outcome != jobCancelled || result.Dispensed != 1 {
+		t.Errorf("Result = %+v, want cancelled after 1", result)
+	}
+}
+
+func TestAPIKeyRequired(t *testing.T) {
+	useTestConfig(t)
+	config.APIKeys = []string{"secret"}
+	_, routes := newTestRoutes(t)
+
+	for _, header := range [][]string{
+		nil,
+		{"X-API-Key", "wrong"},
+		{"Authorization", "Bearer wrong"},
+	} {
+		w := serve(routes, http.MethodPost, "/api/dispense", "application/json", `{"tickets": 1}`, header...)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%v: status = %d, want %d", header, w.Code, http.StatusUnauthorized)
+		}
+		if body := decodeBody(t, w); body["error"] != "Unauthorized" {
+			t.Errorf("%v: error = %v", header, body["error"])
+		}
+	}
+
+	w := serve(routes, http.MethodPost, "/api/dispense", "application/json", `{"tickets": 1}`, "Authorization", "Bearer secret")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("with key: status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	// Reads stay open for the kiosk
+	w = serve(routes, http.MethodGet, "/api/status", "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("status without key = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long open requests get to finish once the
+// server has been asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+var (
+	// shutdownCtx is cancelled with errShuttingDown when the process has
+	// been asked to stop, and shutdown is its Done channel. Dispense runs,
+	// the queue worker and streaming handlers all watch it.
+	shutdownCtx, stopAll = context.WithCancelCause(context.Background())
+	shutdown             = shutdownCtx.Done()
+)
+
+func shuttingDown() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then stops the machine in
+// order: refuse new work, stop the motors, drain HTTP, let the workers record
+// interrupted jobs, flush history and leave the pins safe.
+func waitForShutdown(servers []*http.Server, dispensers []*Dispenser) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	slog.Info("Shutting down", "signal", sig.String())
+
+	// Cancelled under mutex like any other stop, so a motor ramp can't
+	// switch a motor back on after it is driven low below
+	mutex.Lock()
+	stopAll(errShuttingDown)
+	mutex.Unlock()
+	for _, d := range dispensers {
+		d.hw.SetLow()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down web server", "addr", server.Addr, "err", err)
+		}
+	}
+
+	for _, d := range dispensers {
+		<-d.done
+	}
+	history.Close()
+	enterSafeState("shutdown", dispensers...)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// simulatedHardware stands in for the dispenser when no GPIO is available.
+// While the motor is on it feeds one ticket every interval, holding the
+// sensor at config.SensorActive for pulseWidth at the end of each one. Motor run time carries over
+// between runs the way a real roll does, and at part speed it builds up in
+// proportion to the duty cycle. With jamAfter set, the feed stops producing
+// tickets once that many have come out since startup, and with stuck set
+// the motor keeps running once it has been started, like a welded relay.
+type simulatedHardware struct {
+	interval   time.Duration
+	pulseWidth time.Duration
+	jamAfter   int
+	stuck      bool
+	// active and idle are the sensor levels with and without a notch in
+	// front of it.
+	active, idle rpio.State
+
+	mu        sync.Mutex
+	motorOn   bool
+	duty      float64
+	onSince   time.Time
+	runBefore time.Duration
+}
+
+// simPulseWidth is how long a simulated ticket holds the sensor active.
+func simPulseWidth(interval time.Duration) time.Duration {
+	return min(20*time.Millisecond, interval/2)
+}
+
+func newSimulatedHardware(interval time.Duration, jamAfter int, stuck bool) *simulatedHardware {
+	s := &simulatedHardware{
+		interval:   interval,
+		pulseWidth: simPulseWidth(interval),
+		jamAfter:   jamAfter,
+		stuck:      stuck,
+		active:     rpio.High,
+		idle:       rpio.Low,
+	}
+	if config.SensorActive == "low" {
+		s.active, s.idle = rpio.Low, rpio.High
+	}
+	return s
+}
+
+func (s *simulatedHardware) SetHigh() {
+	s.SetDuty(1)
+}
+
+func (s *simulatedHardware) SetDuty(duty float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.motorOn {
+		s.runBefore = s.run()
+	}
+	s.motorOn = true
+	s.duty = duty
+	s.onSince = clock.Now()
+}
+
+func (s *simulatedHardware) SetLow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.motorOn && !s.stuck {
+		s.runBefore = s.run()
+		s.motorOn = false
+	}
+}
+
+// run is how far the roll has been fed, as motor time at full speed. The
+// caller must hold mu.
+func (s *simulatedHardware) run() time.Duration {
+	run := s.runBefore
+	if s.motorOn {
+		run += time.Duration(float64(since(s.onSince)) * s.duty)
+	}
+	return run
+}
+
+func (s *simulatedHardware) ReadSensor() rpio.State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := s.run()
+	ticket := int(run/s.interval) + 1
+	if s.jamAfter > 0 && ticket > s.jamAfter {
+		return s.idle
+	}
+
+	if run%s.interval >= s.interval-s.pulseWidth {
+		return s.active
+	}
+	return s.idle
+}
+
+func (s *simulatedHardware) SafeState() []PinReport {
+	s.SetLow()
+	return s.Pins()
+}
+
+func (s *simulatedHardware) Pins() []PinReport {
+	s.mu.Lock()
+	motor := rpio.Low
+	if s.motorOn {
+		motor = rpio.High
+	}
+	s.mu.Unlock()
+
+	return []PinReport{
+		{Name: "dispenser", Mode: "simulated", Level: levelName(motor)},
+		{Name: "sensor", Mode: "simulated", Level: levelName(s.ReadSensor())},
+	}
+}
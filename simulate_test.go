@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+func TestSimulatedHardwareSensorActive(t *testing.T) {
+	for _, tt := range []struct {
+		sensorActive string
+		resting      rpio.State
+	}{
+		{"high", rpio.Low},
+		{"low", rpio.High},
+	} {
+		t.Run(tt.sensorActive, func(t *testing.T) {
+			useTestConfig(t)
+			config.SensorActive = tt.sensorActive
+			clk := useFakeClock(t)
+
+			hw := newSimulatedHardware(20*time.Millisecond, 0, false)
+			if got := hw.ReadSensor(); got != tt.resting {
+				t.Errorf("resting level = %v, want %v", got, tt.resting)
+			}
+
+			d := newDispenser("main", hw)
+			result, err := clk.dispense(d, 3, nil)
+			if err != nil || result.Dispensed != 3 {
+				t.Errorf("Result = %+v, err = %v, want 3 dispensed", result, err)
+			}
+		})
+	}
+}
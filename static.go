@@ -0,0 +1,165 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// webAssets is the built-in web UI.
+//
+//go:embed web
+var webAssets embed.FS
+
+// staticTypes lists the file extensions the UI is allowed to serve and the
+// Content-Type each is sent with. Anything else in the static directory
+// (config, state, keys, logs) is never served even if it ends up there.
+var staticTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".txt":   "text/plain; charset=utf-8",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+const notFoundPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Not Found</title>
+    <link rel="stylesheet" href="/style.css">
+</head>
+<body>
+    <div class="container">
+        <div class="card status-card">
+            <h2>Nothing Here</h2>
+            <div class="status-display">That page doesn't exist.</div>
+            <a href="/" class="primary-btn">Back to the ticket machine</a>
+        </div>
+    </div>
+</body>
+</html>`
+
+// staticHandler serves the web UI. Files in the on-disk static directory,
+// when there is one, take precedence over the built-in copies so the UI can
+// be customized without rebuilding. Disk lookups go through an os.Root so
+// nothing outside the directory can be reached, directories are never
+// listed, and dotfiles and unknown file types are answered with the 404 page.
+type staticHandler struct {
+	layers []fs.FS
+}
+
+func newStaticHandler(dir string) (*staticHandler, error) {
+	builtin, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		return nil, err
+	}
+	h := &staticHandler{layers: []fs.FS{builtin}}
+
+	if dir == "" {
+		return h, nil
+	}
+	root, err := os.OpenRoot(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("Serving the built-in web UI")
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening static directory: %w", err)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	slog.Info("Serving the built-in web UI with overrides", "dir", abs)
+
+	h.layers = append([]fs.FS{root.FS()}, h.layers...)
+	return h, nil
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if name == "/" {
+		name = "/index.html"
+	}
+
+	contentType, ok := staticTypes[strings.ToLower(path.Ext(name))]
+	if !ok || hasDotSegment(name) {
+		serveNotFound(w)
+		return
+	}
+
+	f, info := h.open(strings.TrimPrefix(name, "/"))
+	if f == nil {
+		serveNotFound(w)
+		return
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// open returns the first regular file called name across the layers, or nil
+// if there isn't one.
+func (h *staticHandler) open(name string) (fs.File, fs.FileInfo) {
+	for _, layer := range h.layers {
+		f, err := layer.Open(name)
+		if err != nil {
+			continue
+		}
+
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			f.Close()
+			continue
+		}
+		return f, info
+	}
+	return nil, nil
+}
+
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func serveNotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, notFoundPage)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "static")
+	files := map[string]string{
+		"index.html":              "<p>custom</p>",
+		"custom.css":              "body {}",
+		"ticket-machine.json":     `{"apiKeys": ["secret"]}`,
+		".env.txt":                "SECRET=1",
+		".git/notes.txt":          "internal",
+		"assets.css/nested.css":   "a {}",
+		"../secret.txt":           "outside",
+		"../ticket-machine.json":  `{"apiKeys": ["secret"]}`,
+		"fonts/sub/readme.txt":    "fonts",
+		"images/logo.svg":         "<svg/>",
+		"images/logo.unknownext":  "?",
+		"private/cert-backup.pem": "key",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(parent, "secret.txt"), filepath.Join(dir, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newStaticHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantType    string
+		wantContent string
+	}{
+		{"/", http.StatusOK, "text/html; charset=utf-8", "<p>custom</p>"},
+		{"/index.html", http.StatusOK, "text/html; charset=utf-8", "<p>custom</p>"},
+		{"/custom.css", http.StatusOK, "text/css; charset=utf-8", "body {}"},
+		{"/images/logo.svg", http.StatusOK, "image/svg+xml", "<svg/>"},
+		{"/fonts/sub/readme.txt", http.StatusOK, "text/plain; charset=utf-8", "fonts"},
+		// Files missing from the directory fall back to the built-in UI
+		{"/script.js", http.StatusOK, "text/javascript; charset=utf-8", ""},
+
+		{"/../ticket-machine.json", http.StatusNotFound, "", ""},
+		{"/../secret.txt", http.StatusNotFound, "", ""},
+		{"/%2e%2e/secret.txt", http.StatusNotFound, "", ""},
+		{"/images/../../secret.txt", http.StatusNotFound, "", ""},
+		{"/escape.txt", http.StatusNotFound, "", ""},
+		{"/ticket-machine.json", http.StatusNotFound, "", ""},
+		{"/private/cert-backup.pem", http.StatusNotFound, "", ""},
+		{"/images/logo.unknownext", http.StatusNotFound, "", ""},
+		{"/.env.txt", http.StatusNotFound, "", ""},
+		{"/.git/notes.txt", http.StatusNotFound, "", ""},
+		{"/assets.css", http.StatusNotFound, "", ""},
+		{"/images", http.StatusNotFound, "", ""},
+		{"/images/", http.StatusNotFound, "", ""},
+		{"/missing.html", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNotFound {
+				if !strings.Contains(w.Body.String(), "That page doesn't exist.") {
+					t.Errorf("body is not the 404 page: %q", w.Body)
+				}
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+			if tt.wantContent != "" && w.Body.String() != tt.wantContent {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestStaticHandlerMethods(t *testing.T) {
+	h, err := newStaticHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/index.html", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/style.css", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("HEAD status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Stats are the dispensing totals for one day, or for a whole range.
+type Stats struct {
+	Date             string `json:"date,omitempty"`
+	Operations       int    `json:"operations"`
+	TicketsRequested int    `json:"ticketsRequested"`
+	TicketsDispensed int    `json:"ticketsDispensed"`
+	LargestPayout    int    `json:"largestPayout"`
+	Jams             int    `json:"jams"`
+	Timeouts         int    `json:"timeouts"`
+	Cancellations    int    `json:"cancellations"`
+	// MsPerTicket is the average run time per ticket over the runs that
+	// paid anything out, jam retries included.
+	MsPerTicket int64 `json:"avgMsPerTicket"`
+
+	feedMs      int64
+	feedTickets int
+}
+
+func (s *Stats) add(entry HistoryEntry) {
+	s.Operations++
+	s.TicketsRequested += entry.Requested
+	s.TicketsDispensed += entry.Dispensed
+	s.LargestPayout = max(s.LargestPayout, entry.Dispensed)
+
+	switch entry.Outcome {
+	case jobJammed:
+		s.Jams++
+	case jobTimeout:
+		s.Timeouts++
+	case jobCancelled:
+		s.Cancellations++
+	}
+
+	if entry.Dispensed > 0 {
+		s.feedMs += entry.DurationMs
+		s.feedTickets += entry.Dispensed
+	}
+	if s.feedTickets > 0 {
+		s.MsPerTicket = s.feedMs / int64(s.feedTickets)
+	}
+}
+
+// StatsResponse is what GET /api/stats returns. Days only lists days that
+// saw a dispense, oldest first.
+type StatsResponse struct {
+	Timezone string  `json:"timezone"`
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Days     []Stats `json:"days"`
+	Total    Stats   `json:"total"`
+}
+
+// statsHandler totals the history per day from ?from= to ?to=, both
+// inclusive dates in config.Timezone. Both default to today.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	to := today
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid to, use YYYY-MM-DD")
+			return
+		}
+		to = parsed
+	}
+	from := to
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid from, use YYYY-MM-DD")
+			return
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	end := to.AddDate(0, 0, 1)
+
+	response := StatsResponse{
+		Timezone: time.Local.String(),
+		From:     from.Format("2006-01-02"),
+		To:       to.Format("2006-01-02"),
+	}
+	days := map[string]*Stats{}
+	err := history.Each(from, func(entry HistoryEntry) {
+		if entry.Kind != "" || !entry.Time.Before(end) {
+			return
+		}
+
+		date := entry.Time.Local().Format("2006-01-02")
+		day, ok := days[date]
+		if !ok {
+			day = &Stats{Date: date}
+			days[date] = day
+		}
+		day.add(entry)
+		response.Total.add(entry)
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading history")
+		return
+	}
+
+	response.Days = make([]Stats, 0, len(days))
+	for _, day := range days {
+		response.Days = append(response.Days, *day)
+	}
+	sort.Slice(response.Days, func(i, j int) bool {
+		return response.Days[i].Date < response.Days[j].Date
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
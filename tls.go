@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// certValidity is how long a generated self-signed certificate lasts. It is
+// long on purpose: the machine may sit in a cupboard between events, and an
+// expired certificate there means nobody can reach it.
+const certValidity = 10 * 365 * 24 * time.Hour
+
+// ensureCertificate makes sure a certificate and key exist at the given
+// paths, generating a self-signed pair for this machine on first boot. A
+// lone certificate or key is an error rather than being overwritten.
+func ensureCertificate(certPath, keyPath string) error {
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if certErr == nil || keyErr == nil {
+		return fmt.Errorf("found only one of %s and %s; provide both, or remove it to have a new pair generated", certPath, keyPath)
+	}
+	if !os.IsNotExist(certErr) {
+		return fmt.Errorf("checking TLS certificate: %w", certErr)
+	}
+	if !os.IsNotExist(keyErr) {
+		return fmt.Errorf("checking TLS key: %w", keyErr)
+	}
+
+	names, ips := certificateNames()
+	certPEM, keyPEM, err := selfSignedCertificate(names, ips)
+	if err != nil {
+		return fmt.Errorf("generating TLS certificate: %w", err)
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("creating directory for %s: %w", path, err)
+		}
+	}
+	// The key goes first so a failure never leaves a certificate without it
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing TLS key: %w", err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		os.Remove(keyPath)
+		return fmt.Errorf("writing TLS certificate: %w", err)
+	}
+
+	slog.Info("Generated a self-signed certificate", "path", certPath, "names", names, "ips", ips)
+	return nil
+}
+
+// certificateNames is every name and address the machine is likely to be
+// reached by: its mDNS and system host names, localhost, and the addresses
+// of its interfaces.
+func certificateNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	if config.MDNSHost != "" {
+		names = append(names, config.MDNSHost+".local")
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		names = append(names, host)
+		if !strings.Contains(host, ".") {
+			names = append(names, host+".local")
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addrs {
+			if ipnet, ok := address.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return names, ips
+}
+
+// selfSignedCertificate returns a PEM certificate and PKCS #8 key for a
+// fresh P-256 key pair, valid as a server certificate for names and ips.
+func selfSignedCertificate(names []string, ips []net.IP) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "localhost",
+			Organization: []string{config.Name},
+		},
+		// Backdated a little so a clock that is slightly behind still
+		// accepts it
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	if config.MDNSHost != "" {
+		template.Subject.CommonName = config.MDNSHost + ".local"
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// redirectToTLS sends every plain-HTTP request to the same host and path on
+// the HTTPS port. The redirect is temporary so browsers don't remember it if
+// TLS is turned off again, and it keeps the method for API clients.
+func redirectToTLS(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		target := net.JoinHostPort(host, tlsPort)
+		if tlsPort == "443" {
+			target = strings.TrimSuffix(target, ":443")
+		}
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
@@ -0,0 +1,143 @@
+document.addEventListener('DOMContentLoaded', function() {
+    const ticketsInput = document.getElementById('codeTickets');
+    const createBtn = document.getElementById('createBtn');
+    const createResult = document.getElementById('create-result');
+    const codeList = document.getElementById('code-list');
+    const listInfo = document.getElementById('list-info');
+    const expiryButtons = document.querySelectorAll('.preset-btn');
+    const selfTestSummary = document.getElementById('selftest-summary');
+    const selfTestList = document.getElementById('selftest-list');
+    let expiresIn = '2h';
+
+    // Shares the key the main page keeps in this browser
+    function apiFetch(url, options) {
+        options = options || {};
+        const key = localStorage.getItem('apiKey');
+        if (key) {
+            options.headers = Object.assign({}, options.headers, {
+                'Authorization': 'Bearer ' + key
+            });
+        }
+
+        return fetch(url, options).then(response => {
+            if (response.status === 401) {
+                const entered = prompt('This machine requires an API key.', key || '');
+                if (entered && entered.trim()) {
+                    localStorage.setItem('apiKey', entered.trim());
+                }
+            }
+            return response;
+        });
+    }
+
+    // API errors come back as {"error": "..."}
+    function checked(response) {
+        if (!response.ok) {
+            return response.json()
+                .catch(() => ({}))
+                .then(body => {
+                    throw new Error(body.error || response.statusText);
+                });
+        }
+        return response.json();
+    }
+
+    function loadCodes() {
+        apiFetch('/api/codes')
+            .then(checked)
+            .then(codes => {
+                codeList.innerHTML = '';
+                listInfo.textContent = codes.length ? '' : 'No outstanding codes';
+
+                codes.forEach(code => {
+                    const item = document.createElement('li');
+                    const name = document.createElement('span');
+                    name.className = 'code';
+                    name.textContent = code.code;
+                    const detail = document.createElement('span');
+                    detail.textContent = code.tickets + ' ticket(s), until ' +
+                        new Date(code.expiresAt).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+                    item.append(name, detail);
+                    codeList.appendChild(item);
+                });
+            })
+            .catch(error => {
+                listInfo.textContent = error.message;
+            });
+    }
+
+    // Shows the latest self-test, green if every dispenser passed
+    function loadSelfTest() {
+        apiFetch('/api/selftest/history?limit=1')
+            .then(checked)
+            .then(runs => {
+                selfTestList.innerHTML = '';
+                const run = runs[runs.length - 1];
+                if (!run) {
+                    selfTestSummary.className = 'selftest-summary';
+                    selfTestSummary.textContent = 'No self-test has run yet';
+                    return;
+                }
+
+                selfTestSummary.className = 'selftest-summary ' + (run.passed ? 'passed' : 'failed');
+                selfTestSummary.textContent = (run.passed ? 'Passed' : 'Failed') +
+                    (run.scheduled ? ' (scheduled) ' : ' ') +
+                    new Date(run.time).toLocaleString([], { dateStyle: 'short', timeStyle: 'short' });
+
+                run.reports.forEach(report => {
+                    const item = document.createElement('li');
+                    const name = document.createElement('span');
+                    name.textContent = report.dispenser;
+                    const detail = document.createElement('span');
+                    detail.textContent = report.reason;
+                    if (report.testDispense) {
+                        detail.textContent += report.testDispense.passed ? ', test ticket paid out' : '. ' + report.testDispense.reason;
+                    }
+                    item.append(name, detail);
+                    selfTestList.appendChild(item);
+                });
+            })
+            .catch(error => {
+                selfTestSummary.className = 'selftest-summary';
+                selfTestSummary.textContent = error.message;
+            });
+    }
+
+    expiryButtons.forEach(button => {
+        button.classList.toggle('active', button.dataset.value === expiresIn);
+        button.addEventListener('click', function() {
+            expiresIn = this.dataset.value;
+            expiryButtons.forEach(b => b.classList.toggle('active', b === this));
+        });
+    });
+
+    createBtn.addEventListener('click', function() {
+        const tickets = parseInt(ticketsInput.value);
+        if (!(tickets > 0)) {
+            alert('Please enter a valid number of tickets');
+            return;
+        }
+
+        createBtn.disabled = true;
+        apiFetch('/api/codes', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ tickets: tickets, expiresIn: expiresIn })
+        })
+        .then(checked)
+        .then(code => {
+            createResult.textContent = code.code + ' is good for ' + code.tickets + ' ticket(s)';
+            createBtn.disabled = false;
+            loadCodes();
+        })
+        .catch(error => {
+            createResult.textContent = error.message;
+            createBtn.disabled = false;
+        });
+    });
+
+    loadCodes();
+    loadSelfTest();
+    setInterval(loadCodes, 10000);
+    setInterval(loadSelfTest, 60000);
+});
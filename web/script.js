@@ -0,0 +1,454 @@
+document.addEventListener('DOMContentLoaded', function() {
+    // DOM elements
+    const statusElement = document.getElementById('status');
+    const dispensingIndicator = document.getElementById('dispensing-indicator');
+    const ticketCountInput = document.getElementById('ticketCount');
+    const dispenseBtn = document.getElementById('dispenseBtn');
+    const cancelBtn = document.getElementById('cancelBtn');
+    const queueInfo = document.getElementById('queue-info');
+    const maintenanceInfo = document.getElementById('maintenance-info');
+    const controlCard = document.getElementById('control-card');
+    let inMaintenance = false;
+    const inventoryInfo = document.getElementById('inventory-info');
+    const dailyInfo = document.getElementById('daily-info');
+    const advisoryInfo = document.getElementById('advisory-info');
+    const settingsBtn = document.getElementById('settingsBtn');
+    const redeemCard = document.getElementById('redeem-card');
+    const redeemCodeInput = document.getElementById('redeemCode');
+    const redeemBtn = document.getElementById('redeemBtn');
+    const redeemResult = document.getElementById('redeem-result');
+    const dispenserChoice = document.getElementById('dispenser-choice');
+    const dispenserSelect = document.getElementById('dispenserSelect');
+    const statsCard = document.getElementById('stats-card');
+    const statsList = document.getElementById('stats-list');
+
+    // Machines with API keys configured need one on mutating requests. The
+    // key is entered once and kept in this browser only.
+    function promptForKey(message) {
+        const current = localStorage.getItem('apiKey') || '';
+        const key = prompt(message + ' (leave empty to clear)', current);
+        if (key === null) {
+            return;
+        }
+
+        if (key.trim()) {
+            localStorage.setItem('apiKey', key.trim());
+        } else {
+            localStorage.removeItem('apiKey');
+        }
+    }
+
+    function apiFetch(url, options) {
+        options = options || {};
+        const key = localStorage.getItem('apiKey');
+        if (key) {
+            options.headers = Object.assign({}, options.headers, {
+                'Authorization': 'Bearer ' + key
+            });
+        }
+
+        return fetch(url, options).then(response => {
+            if (response.status === 401) {
+                promptForKey('This machine requires an API key.');
+            }
+            return response;
+        });
+    }
+
+    // API errors come back as {"error": "..."}
+    function checked(response) {
+        if (!response.ok) {
+            return response.json()
+                .catch(() => ({}))
+                .then(body => {
+                    throw new Error(body.error || response.statusText);
+                });
+        }
+        return response.json();
+    }
+
+    settingsBtn.addEventListener('click', function() {
+        promptForKey('API key for this machine.');
+    });
+    const decreaseBtn = document.getElementById('decreaseBtn');
+    const increaseBtn = document.getElementById('increaseBtn');
+    const presetButtons = document.querySelectorAll('.preset-btn');
+
+    // Number input controls
+    // Largest request the machine accepts, from /api/info
+    let maxTickets = Infinity;
+
+    function clampTicketCount(count) {
+        return Math.min(Math.max(1, count), maxTickets);
+    }
+
+    function updateTicketCount(value) {
+        let count = parseInt(ticketCountInput.value) || 1;
+        count += value;
+
+        ticketCountInput.value = clampTicketCount(count);
+    }
+
+    // Size the controls to the machine's limits instead of guessing
+    fetch('/api/info')
+        .then(response => response.json())
+        .then(info => {
+            maxTickets = info.limits.maxTicketsPerRequest;
+            ticketCountInput.max = maxTickets;
+            ticketCountInput.value = clampTicketCount(parseInt(ticketCountInput.value) || 1);
+            presetButtons.forEach(button => {
+                button.hidden = parseInt(button.dataset.value) > maxTickets;
+            });
+
+            // With several hoppers, let the user pick one or leave it to
+            // whichever can pay out soonest
+            if (info.dispensers.length > 1) {
+                dispenserSelect.add(new Option('Fastest available', ''));
+                info.dispensers.forEach(dispenser => {
+                    dispenserSelect.add(new Option(dispenser.name, dispenser.name));
+                });
+                dispenserChoice.hidden = false;
+            }
+        })
+        .catch(error => {
+            console.error('Error fetching machine info:', error);
+        });
+
+    decreaseBtn.addEventListener('click', function() {
+        updateTicketCount(-1);
+    });
+
+    increaseBtn.addEventListener('click', function() {
+        updateTicketCount(1);
+    });
+
+    // Handle preset buttons
+    presetButtons.forEach(button => {
+        button.addEventListener('click', function() {
+            const value = parseInt(this.dataset.value);
+            ticketCountInput.value = value;
+
+            // Visual feedback - highlight selected preset
+            presetButtons.forEach(btn => btn.classList.remove('active'));
+            this.classList.add('active');
+        });
+    });
+
+    // Ensure input is valid on manual change
+    ticketCountInput.addEventListener('change', function() {
+        this.value = clampTicketCount(parseInt(this.value) || 1);
+
+        // Reset preset button highlights
+        presetButtons.forEach(btn => btn.classList.remove('active'));
+    });
+
+    // Today's totals, in the machine's time zone, worked out by the server
+    function updateStats() {
+        fetch('/api/stats')
+            .then(checked)
+            .then(stats => {
+                const today = stats.total;
+                const rows = [
+                    ['Tickets out', today.ticketsDispensed],
+                    ['Dispenses', today.operations],
+                    ['Biggest payout', today.largestPayout],
+                    ['Jams', today.jams],
+                    ['Cancelled', today.cancellations],
+                    ['Average per ticket', today.avgMsPerTicket ? (today.avgMsPerTicket / 1000).toFixed(2) + 's' : '-']
+                ];
+                statsList.replaceChildren(...rows.flatMap(([label, value]) => {
+                    const term = document.createElement('dt');
+                    term.textContent = label;
+                    const detail = document.createElement('dd');
+                    detail.textContent = value;
+                    return [term, detail];
+                }));
+            })
+            .catch(error => {
+                console.error('Error fetching stats:', error);
+            });
+    }
+
+    statsCard.addEventListener('toggle', function() {
+        if (statsCard.open) {
+            updateStats();
+        }
+    });
+
+    // Render a status update from either the event stream or polling
+    let wasDispensing = false;
+
+    function renderStatus(data) {
+        const dispensers = data.dispensers || [data];
+        const multiple = dispensers.length > 1;
+
+        if (multiple) {
+            statusElement.replaceChildren(...dispensers.map(dispenser => {
+                const line = document.createElement('div');
+                line.className = 'dispenser-status';
+                line.textContent = dispenser.name + ': ' + (dispenser.status || 'Idle');
+                return line;
+            }));
+        } else {
+            statusElement.textContent = data.status;
+        }
+
+        // Refresh the open stats card as each run finishes
+        const dispensing = dispensers.some(dispenser => dispenser.isDispensing);
+        if (wasDispensing && !dispensing && statsCard.open) {
+            updateStats();
+        }
+        wasDispensing = dispensing;
+
+        // Update dispensing indicator
+        if (dispensing) {
+            dispensingIndicator.classList.add('active');
+            cancelBtn.classList.add('active');
+        } else {
+            dispensingIndicator.classList.remove('active');
+            cancelBtn.classList.remove('active');
+            cancelBtn.disabled = false;
+        }
+
+        // Requests made while dispensing wait in the queue
+        const queued = dispensers.reduce((sum, dispenser) => sum + dispenser.queued, 0);
+        const pending = dispensers.reduce((sum, dispenser) => sum + dispenser.ticketsPending, 0);
+        if (queued > 0) {
+            queueInfo.textContent = queued + ' queued, ' + pending + ' ticket(s) pending';
+        } else {
+            queueInfo.textContent = '';
+        }
+
+        // Only shown once a refill has been recorded
+        const stocked = dispensers.filter(dispenser => dispenser.ticketsRemaining !== undefined);
+        if (stocked.length > 0) {
+            inventoryInfo.textContent = stocked.map(dispenser => {
+                return (multiple ? dispenser.name + ': ' : '') +
+                    (dispenser.lowTicket ? 'Low on tickets: ' : '') + dispenser.ticketsRemaining + ' ticket(s) left';
+            }).join(', ');
+            inventoryInfo.classList.toggle('low', stocked.some(dispenser => dispenser.lowTicket));
+        } else {
+            inventoryInfo.textContent = '';
+        }
+
+        if (data.dailyTicketsLeft !== undefined) {
+            dailyInfo.textContent = data.dailyTicketsLeft + ' ticket(s) left under today\'s limit';
+            dailyInfo.classList.toggle('low', data.dailyTicketsLeft === 0);
+        } else {
+            dailyInfo.textContent = '';
+        }
+
+        // Warned ahead of the daily cap or a dispenser running out
+        if (data.advisories && data.advisories.length > 0) {
+            advisoryInfo.textContent = 'Running low — large dispenses may be limited';
+        } else {
+            advisoryInfo.textContent = '';
+        }
+
+        // Dispensing is refused while the machine is being serviced
+        inMaintenance = data.maintenance;
+        controlCard.classList.toggle('maintenance', inMaintenance);
+        redeemCard.classList.toggle('maintenance', inMaintenance);
+        dispenseBtn.disabled = inMaintenance;
+        redeemBtn.disabled = inMaintenance;
+        if (inMaintenance) {
+            maintenanceInfo.textContent = 'Maintenance mode' + (data.maintenanceReason ? ': ' + data.maintenanceReason : '');
+        } else {
+            maintenanceInfo.textContent = '';
+        }
+    }
+
+    // Polling fallback for browsers or networks where SSE doesn't work
+    function updateStatus() {
+        fetch('/api/status')
+            .then(response => response.json())
+            .then(renderStatus)
+            .catch(error => {
+                console.error('Error fetching status:', error);
+                statusElement.textContent = 'Error connecting to server';
+            });
+    }
+
+    let pollTimer = null;
+
+    function startPolling() {
+        if (pollTimer) {
+            return;
+        }
+        updateStatus();
+        pollTimer = setInterval(updateStatus, 1000);
+    }
+
+    // Prefer live updates over SSE, falling back to polling every second
+    if (window.EventSource) {
+        const events = new EventSource('/api/events');
+
+        events.onmessage = function(event) {
+            renderStatus(JSON.parse(event.data));
+        };
+
+        events.onerror = function() {
+            console.error('Status stream lost, falling back to polling');
+            events.close();
+            startPolling();
+        };
+    } else {
+        startPolling();
+    }
+
+    // How many times a dispense that got no answer is sent again, and how
+    // long to wait for one before giving up on an attempt
+    const dispenseRetries = 3;
+    const dispenseTimeout = 8000;
+
+    function newIdempotencyKey() {
+        // crypto.randomUUID needs HTTPS, random values don't
+        const bytes = crypto.getRandomValues(new Uint8Array(16));
+        return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+    }
+
+    // Only a request that never got an answer is retried, always with the
+    // same key, so one that reached the machine before the Wi-Fi dropped
+    // gets its original job back instead of a second payout
+    function dispenseWithRetry(formData, key, retries) {
+        const controller = new AbortController();
+        const timer = setTimeout(() => controller.abort(), dispenseTimeout);
+
+        return apiFetch('/api/dispense', {
+            method: 'POST',
+            headers: { 'Idempotency-Key': key },
+            body: formData,
+            signal: controller.signal
+        })
+        .finally(() => clearTimeout(timer))
+        .catch(error => {
+            if (retries <= 0) {
+                throw error;
+            }
+            console.warn('Dispense request failed, retrying:', error);
+            return new Promise(resolve => setTimeout(resolve, 1000))
+                .then(() => dispenseWithRetry(formData, key, retries - 1));
+        });
+    }
+
+    // Handle dispense button click
+    dispenseBtn.addEventListener('click', function() {
+        const ticketCount = ticketCountInput.value;
+
+        if (ticketCount < 1) {
+            alert('Please enter a valid number of tickets');
+            return;
+        }
+
+        // Disable button to prevent multiple clicks
+        dispenseBtn.disabled = true;
+
+        // Add active visual feedback
+        dispenseBtn.style.backgroundColor = '#2A4E80';
+        setTimeout(() => {
+            dispenseBtn.style.backgroundColor = '';
+        }, 300);
+
+        // Send dispense request. One key per press makes the retries below
+        // safe: the machine pays out a key only once.
+        const formData = new FormData();
+        formData.append('tickets', ticketCount);
+        if (!dispenserChoice.hidden) {
+            if (dispenserSelect.value) {
+                formData.append('dispenser', dispenserSelect.value);
+            } else {
+                formData.append('split', 'true');
+            }
+        }
+
+        dispenseWithRetry(formData, newIdempotencyKey(), dispenseRetries)
+        .then(checked)
+        .then(data => {
+            console.log('Success:', data);
+            // Status updates will be handled by the polling function
+            dispenseBtn.disabled = inMaintenance;
+        })
+        .catch(error => {
+            console.error('Error:', error);
+            statusElement.textContent = 'Error: ' + error.message;
+            dispenseBtn.disabled = inMaintenance;
+        });
+    });
+
+    // Handle cancel button click
+    cancelBtn.addEventListener('click', function() {
+        cancelBtn.disabled = true;
+
+        // Cancelling with "Fastest available" picked stops every dispenser
+        const formData = new FormData();
+        if (!dispenserChoice.hidden && dispenserSelect.value) {
+            formData.append('dispenser', dispenserSelect.value);
+        }
+
+        apiFetch('/api/cancel', {
+            method: 'POST',
+            body: formData
+        })
+        .then(checked)
+        .then(data => {
+            console.log('Cancelled:', data);
+        })
+        .catch(error => {
+            console.error('Error:', error);
+            statusElement.textContent = 'Error: ' + error.message;
+            cancelBtn.disabled = false;
+        });
+    });
+
+    // Codes are their own credential, so redeeming doesn't need an API key
+    function redeemCode() {
+        const code = redeemCodeInput.value.trim().toUpperCase();
+        if (!code) {
+            return;
+        }
+
+        redeemBtn.disabled = true;
+        redeemResult.classList.remove('low');
+
+        fetch('/api/redeem', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ code: code })
+        })
+        .then(checked)
+        .then(data => {
+            redeemResult.textContent = 'Code ' + data.code + ': ' + data.message;
+            redeemCodeInput.value = '';
+            redeemBtn.disabled = inMaintenance;
+        })
+        .catch(error => {
+            redeemResult.textContent = error.message;
+            redeemResult.classList.add('low');
+            redeemBtn.disabled = inMaintenance;
+        });
+    }
+
+    redeemBtn.addEventListener('click', redeemCode);
+    redeemCodeInput.addEventListener('keydown', function(event) {
+        if (event.key === 'Enter') {
+            redeemCode();
+        }
+    });
+
+    // Add touch-friendly features for mobile
+    document.querySelectorAll('button').forEach(button => {
+        // Remove outline on touch
+        button.addEventListener('touchstart', function() {
+            this.style.outline = 'none';
+        });
+
+        // Add active state for touch feedback
+        button.addEventListener('touchstart', function() {
+            this.classList.add('touching');
+        });
+
+        button.addEventListener('touchend', function() {
+            this.classList.remove('touching');
+        });
+    });
+});
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Webhook event names.
+const (
+	eventDispenseStarted   = "dispense_started"
+	eventDispenseCompleted = "dispense_completed"
+	eventJamDetected       = "jam_detected"
+	eventTimeout           = "timeout"
+	eventFault             = "fault"
+	eventSelfTestFailed    = "selftest_failed"
+	eventSelfTestRecovered = "selftest_recovered"
+	eventMaintenanceDue    = "maintenance_due"
+	eventRunningLow        = "running_low"
+	eventTest              = "test"
+)
+
+// webhookAttempts is how many times a delivery is tried before giving up.
+// The wait between attempts starts at webhookBackoff and doubles.
+const (
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+)
+
+// WebhookEvent is the JSON body POSTed to every configured webhook.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Machine   string    `json:"machine"`
+	JobID     string    `json:"jobId,omitempty"`
+	Dispenser string    `json:"dispenser,omitempty"`
+	Requested int       `json:"requested,omitempty"`
+	Dispensed int       `json:"dispensed"`
+	Outcome   string    `json:"outcome,omitempty"`
+	// Reason says what went wrong, for jams and faults.
+	Reason string `json:"reason,omitempty"`
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// notifyWebhooks delivers an event to every configured webhook in the
+// background, so callers on the dispense path never wait on the network.
+func notifyWebhooks(event WebhookEvent) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Machine = config.Name
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding webhook event", "event", event.Event, "err", err)
+		return
+	}
+
+	for _, url := range config.Webhooks {
+		go deliverWebhook(url, event.Event, body)
+	}
+}
+
+// jobEvents are the webhook events for a finished job: every run reports
+// dispense_completed, and jams and timeouts are called out on their own too.
+func jobEvents(entry HistoryEntry) []WebhookEvent {
+	event := WebhookEvent{
+		JobID:     entry.JobID,
+		Dispenser: entry.Dispenser,
+		Requested: entry.Requested,
+		Dispensed: entry.Dispensed,
+		Outcome:   entry.Outcome,
+	}
+
+	completed := event
+	completed.Event = eventDispenseCompleted
+	events := []WebhookEvent{completed}
+
+	switch entry.Outcome {
+	case jobJammed:
+		event.Event = eventJamDetected
+		event.Reason = entry.Stall
+		events = append(events, event)
+	case jobTimeout:
+		event.Event = eventTimeout
+		events = append(events, event)
+	}
+	return events
+}
+
+func deliverWebhook(url, name string, body []byte) {
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(url, name, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			slog.Error("Giving up on webhook", "event", name, "url", url, "attempts", attempt, "err", err)
+			return
+		}
+
+		slog.Warn("Webhook failed, retrying", "event", name, "url", url, "attempt", attempt, "retryIn", wait, "err", err)
+		select {
+		case <-time.After(wait):
+		case <-shutdown:
+			return
+		}
+		wait *= 2
+	}
+}
+
+func postWebhook(url, name string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ticket-machine/"+version)
+	req.Header.Set("X-Ticket-Machine-Event", name)
+	if config.WebhookSecret != "" {
+		req.Header.Set("X-Ticket-Machine-Signature", "sha256="+signWebhook(body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook is the hex HMAC-SHA256 of the body under config.WebhookSecret,
+// which receivers recompute to check the event came from this machine.
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookTestHandler sends a test event to every webhook once, without
+// retries, and reports how each receiver answered.
+func webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if len(config.Webhooks) == 0 {
+		writeError(w, http.StatusConflict, "No webhooks configured")
+		return
+	}
+
+	body, err := json.Marshal(WebhookEvent{
+		Event:   eventTest,
+		Time:    time.Now(),
+		Machine: config.Name,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error encoding test event")
+		return
+	}
+
+	type result struct {
+		URL     string `json:"url"`
+		OK      bool   `json:"ok"`
+		Message string `json:"error,omitempty"`
+	}
+	results := make([]result, len(config.Webhooks))
+	for i, url := range config.Webhooks {
+		results[i] = result{URL: url, OK: true}
+		if err := postWebhook(url, eventTest, body); err != nil {
+			results[i] = result{URL: url, Message: err.Error()}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}